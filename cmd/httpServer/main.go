@@ -1,27 +1,57 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 	"github.com/juancruzfl/httpserver/internal/server"
 	"github.com/juancruzfl/httpserver/internal/response"
 	"github.com/juancruzfl/httpserver/internal/request"
 )
 
 func main() {
+	server.MyDefaultMux.HandleFunc("GET", "/", func(w response.ResponseWriter, r *request.Request) {
+		fmt.Printf("Handled GET / request\n")
+		w.Write([]byte("Hello, World!\n"))
+	})
+	server.MyDefaultMux.HandleFunc("POST", "/upload", func(w response.ResponseWriter, r *request.Request) {
+		w.GetHeaders().Set("Content-Type", "application/json")
+		w.CustomWriteHeader(201)
+		w.Write([]byte(`{"status":"success"}`))
+	})
+
+	srv := &server.Server{Addr: ":8000"}
+
 	errChan := make(chan error, 1)
 	go func () {
-		server.MyDefaultMux.HandleFunc("GET", "/", func(w response.ResponseWriter, r *request.Request) {
-			fmt.Printf("Handled GET / request\n")		
-			w.Write([]byte("Hello, World!\n"))
-		})
-		server.MyDefaultMux.HandleFunc("POST", "/upload", func(w response.ResponseWriter, r *request.Request) {
-			w.GetHeaders().Set("Content-Type", "application/json")
-			w.CustomWriteHeader(201)
-			w.Write([]byte(`{"status":"success"}`))
-		})
-		fmt.Printf("Server started running")
-		errChan <- server.CustomListenAndServe(":8000", nil)
+		fmt.Println("Server started running")
+		errChan <- srv.ListenAndServe()
 	}()
-	err := <- errChan
-	fmt.Printf("Server stopped: ", err)
+
+	// sidenote: instead of letting ctrl-c kill the process in the middle of a response, we wait for the signal and give the requests that are
+	// still being handled some time to finish.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case err := <- errChan:
+		fmt.Printf("Server stopped: %v\n", err)
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+
+	fmt.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		fmt.Printf("Shutdown did not finish cleanly: %v\n", err)
+		srv.Close()
+	}
+	if err := <- errChan; !errors.Is(err, server.ErrServerClosed) {
+		fmt.Printf("Server stopped: %v\n", err)
+	}
 }
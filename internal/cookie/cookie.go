@@ -0,0 +1,196 @@
+package cookie
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/juancruzfl/httpserver/internal/headers"
+)
+
+// ErrNoCookie is returned by Request.Cookie when the request has no cookie with the given name.
+var ErrNoCookie = errors.New("Named cookie not present")
+
+// ErrInvalidCookie is returned when a cookie can't be put on a Set-Cookie line as it is.
+var ErrInvalidCookie = errors.New("Invalid cookie")
+
+// TimeFormat is the date format of the Expires attribute, the same IMF-fixdate HTTP uses everywhere else.
+const TimeFormat = headers.TimeFormat
+
+type SameSite int
+const (
+	// SameSiteDefault leaves the attribute out, letting the browser pick (Lax in most of them).
+	SameSiteDefault SameSite = 0
+	SameSiteLax SameSite = 1
+	SameSiteStrict SameSite = 2
+	SameSiteNone SameSite = 3
+)
+
+// Cookie is an HTTP cookie as defined in RFC 6265. Cookies parsed from a request only have a Name and a Value, since the Cookie header doesn't
+// carry attributes. The rest of the fields are for cookies sent with Set-Cookie.
+type Cookie struct {
+	Name string
+	Value string
+	// Quoted reports whether the value was (or should be) wrapped in double quotes.
+	Quoted bool
+
+	Path string
+	Domain string
+	// Expires is left out when zero.
+	Expires time.Time
+	// MaxAge is left out when zero. A negative MaxAge asks the browser to delete the cookie right away and is sent as Max-Age=0.
+	MaxAge int
+	Secure bool
+	HttpOnly bool
+	SameSite SameSite
+	// Partitioned keeps the cookie in a separate jar per top level site (CHIPS). Browsers require such cookies to be Secure.
+	Partitioned bool
+}
+
+// Valid checks the cookie against the grammar of a Set-Cookie line, returning an error wrapping ErrInvalidCookie for the first problem found.
+func (c *Cookie) Valid() error {
+	if !headers.IsToken(c.Name) {
+		return fmt.Errorf("%w: invalid name %q", ErrInvalidCookie, c.Name)
+	}
+	for i := 0; i < len(c.Value); i++ {
+		if !validValueByte(c.Value[i]) && c.Value[i] != ' ' && c.Value[i] != ',' {
+			return fmt.Errorf("%w: invalid byte %q in the value of %s", ErrInvalidCookie, c.Value[i], c.Name)
+		}
+	}
+	if !validAttributeValue(c.Path) {
+		return fmt.Errorf("%w: invalid path %q", ErrInvalidCookie, c.Path)
+	}
+	if c.Domain != "" && !validDomain(c.Domain) {
+		return fmt.Errorf("%w: invalid domain %q", ErrInvalidCookie, c.Domain)
+	}
+	if !c.Expires.IsZero() && c.Expires.Year() < 1601 {
+		return fmt.Errorf("%w: expiry before 1601", ErrInvalidCookie)
+	}
+	if c.Partitioned && !c.Secure {
+		return fmt.Errorf("%w: a partitioned cookie has to be secure", ErrInvalidCookie)
+	}
+	return nil
+}
+
+// String serializes the cookie for a Set-Cookie header, or for a Cookie header when only the name and value are set. It returns "" for a cookie
+// that isn't valid.
+func (c *Cookie) String() string {
+	if c.Valid() != nil {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(c.Name)
+	b.WriteString("=")
+	if c.Quoted || needsQuotes(c.Value) {
+		b.WriteString("\"" + c.Value + "\"")
+	} else {
+		b.WriteString(c.Value)
+	}
+
+	if c.Path != "" {
+		b.WriteString("; Path=" + c.Path)
+	}
+	if c.Domain != "" {
+		b.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + c.Expires.UTC().Format(TimeFormat))
+	}
+	if c.MaxAge > 0 {
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	switch c.SameSite {
+	case SameSiteLax:
+		b.WriteString("; SameSite=Lax")
+	case SameSiteStrict:
+		b.WriteString("; SameSite=Strict")
+	case SameSiteNone:
+		b.WriteString("; SameSite=None")
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String()
+}
+
+// Parse parses the value of a Cookie request header, "a=1; b=2". Pairs that don't follow the grammar are left out rather than failing the whole
+// header, since browsers are known to send the odd malformed cookie set by some other site on the same domain.
+func Parse(line string) []*Cookie {
+	var cookies []*Cookie
+	for _, part := range strings.Split(line, ";") {
+		part = strings.Trim(part, " \t")
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		if !headers.IsToken(name) {
+			continue
+		}
+		quoted := false
+		if len(value) > 1 && value[0] == '"' && value[len(value) - 1] == '"' {
+			value = value[1:len(value) - 1]
+			quoted = true
+		}
+		valid := true
+		for i := 0; i < len(value); i++ {
+			if !validValueByte(value[i]) {
+				valid = false
+				break
+			}
+		}
+		if !valid {
+			continue
+		}
+		cookies = append(cookies, &Cookie{Name: name, Value: value, Quoted: quoted})
+	}
+	return cookies
+}
+
+// validValueByte reports whether b is a cookie-octet: US-ASCII without controls, whitespace, double quotes, commas, semicolons and backslashes.
+func validValueByte(b byte) bool {
+	return b == 0x21 || (b >= 0x23 && b <= 0x2b) || (b >= 0x2d && b <= 0x3a) || (b >= 0x3c && b <= 0x5b) || (b >= 0x5d && b <= 0x7e)
+}
+
+// sidenote: spaces and commas aren't cookie-octets, but plenty of cookies out there have them. Like most servers we allow them by quoting the
+// value, which every browser understands.
+func needsQuotes(value string) bool {
+	return strings.ContainsAny(value, " ,")
+}
+
+// validAttributeValue reports whether v can be used for the Path attribute: any character but controls and semicolons.
+func validAttributeValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if v[i] < 0x20 || v[i] == 0x7f || v[i] == ';' {
+			return false
+		}
+	}
+	return true
+}
+
+func validDomain(domain string) bool {
+	domain = strings.TrimPrefix(domain, ".")
+	if domain == "" || len(domain) > 255 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label) - 1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
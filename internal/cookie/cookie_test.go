@@ -0,0 +1,55 @@
+package cookie
+
+import (
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookieString(t *testing.T) {
+	c := &Cookie{
+		Name: "session",
+		Value: "abc123",
+		Path: "/",
+		Domain: ".example.com",
+		Expires: time.Date(2030, time.January, 2, 3, 4, 5, 0, time.UTC),
+		MaxAge: 3600,
+		Secure: true,
+		HttpOnly: true,
+		SameSite: SameSiteStrict,
+		Partitioned: true,
+	}
+	require.NoError(t, c.Valid())
+	assert.Equal(t, "session=abc123; Path=/; Domain=example.com; Expires=Wed, 02 Jan 2030 03:04:05 GMT; Max-Age=3600; HttpOnly; Secure; SameSite=Strict; Partitioned", c.String())
+
+	assert.Equal(t, "gone=; Max-Age=0", (&Cookie{Name: "gone", MaxAge: -1}).String())
+	assert.Equal(t, "spaced=\"a b,c\"", (&Cookie{Name: "spaced", Value: "a b,c"}).String())
+}
+
+func TestInvalidCookies(t *testing.T) {
+	cookies := []*Cookie{
+		{Name: "", Value: "x"},
+		{Name: "bad name", Value: "x"},
+		{Name: "a", Value: "x;y"},
+		{Name: "a", Value: "x\r\nSet-Cookie: b=1"},
+		{Name: "a", Value: "x\""},
+		{Name: "a", Path: "/;Domain=evil.com"},
+		{Name: "a", Domain: "exa mple.com"},
+		{Name: "a", Expires: time.Date(1500, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{Name: "a", Partitioned: true},
+	}
+	for _, c := range cookies {
+		assert.ErrorIs(t, c.Valid(), ErrInvalidCookie, "cookie %+v", c)
+		assert.Equal(t, "", c.String())
+	}
+}
+
+func TestParse(t *testing.T) {
+	cookies := Parse("a=1; b=\"quoted\";c=; bad name=2; d=x\\y;  e=5")
+	require.Len(t, cookies, 4)
+	assert.Equal(t, Cookie{Name: "a", Value: "1"}, *cookies[0])
+	assert.Equal(t, Cookie{Name: "b", Value: "quoted", Quoted: true}, *cookies[1])
+	assert.Equal(t, Cookie{Name: "c", Value: ""}, *cookies[2])
+	assert.Equal(t, Cookie{Name: "e", Value: "5"}, *cookies[3])
+}
@@ -0,0 +1,306 @@
+package handler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"github.com/juancruzfl/httpserver/internal/headers"
+	"github.com/juancruzfl/httpserver/internal/request"
+	"github.com/juancruzfl/httpserver/internal/response"
+)
+
+// minCompressSize is the smallest body worth compressing. Below it the gzip header and trailer eat most of what compression saves.
+const minCompressSize = 1024
+
+// incompressibleTypes are content types that are compressed already, where a second pass only costs CPU.
+var incompressibleTypes = []string{
+	"image/", "video/", "audio/", "font/woff", "application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-bzip2", "application/x-7z-compressed", "application/x-rar-compressed", "application/pdf", "application/octet-stream",
+}
+
+// compressor pools the encoders of one kind, since setting up a fresh one allocates several hundred kilobytes of tables.
+type compressor struct {
+	encoding string
+	pool sync.Pool
+}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// Compress returns middleware that compresses response bodies with gzip or deflate, whichever the client prefers in Accept-Encoding, at the
+// given compress/flate level. Bodies smaller than a kilobyte, bodies of content types that are compressed already and responses that set their
+// own Content-Encoding are sent as they are.
+//
+// sidenote: the handler is given a writer that holds back the first kilobyte of the body. Only once it has that much can it tell whether
+// compressing is worth it, and by then the headers are still unsent, so it can still swap Content-Length for Content-Encoding.
+func Compress(level int) Middleware {
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		panic("Invalid compression level " + strconv.Itoa(level))
+	}
+	gzipPool := &compressor{encoding: "gzip"}
+	gzipPool.pool.New = func() any {
+		w, _ := gzip.NewWriterLevel(io.Discard, level)
+		return w
+	}
+	deflatePool := &compressor{encoding: "deflate"}
+	deflatePool.pool.New = func() any {
+		w, _ := zlib.NewWriterLevel(io.Discard, level)
+		return w
+	}
+
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w response.ResponseWriter, r *request.Request) {
+			w.GetHeaders().Add("Vary", "Accept-Encoding")
+			var c *compressor
+			switch negotiateEncoding(r) {
+			case "gzip":
+				c = gzipPool
+			case "deflate":
+				c = deflatePool
+			}
+			if c == nil {
+				next.ServeHttp(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, compressor: c, status: response.StatusOK, head: r.RequestLine.Method == "HEAD"}
+			next.ServeHttp(cw, r)
+			cw.Close()
+		})
+	}
+}
+
+// negotiateEncoding picks gzip or deflate from Accept-Encoding, going by the q-values and preferring gzip on a tie. It returns "" when the client
+// accepts neither.
+func negotiateEncoding(r *request.Request) string {
+	accept, ok := r.Headers.Get("Accept-Encoding")
+	if !ok {
+		return ""
+	}
+	quality := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(name), "q") {
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil || parsed < 0 || parsed > 1 {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+		quality[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range []string{"gzip", "deflate"} {
+		q, ok := quality[coding]
+		if !ok {
+			if coding == "gzip" {
+				q, ok = quality["x-gzip"]
+			}
+			if !ok {
+				q = quality["*"]
+			}
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compressWriter buffers the start of the body until it knows whether to compress, then either streams everything through an encoder or
+// passes it on untouched.
+type compressWriter struct {
+	response.ResponseWriter
+	compressor *compressor
+	status int
+	wroteHeader bool
+	decided bool
+	encoder encoder
+	buffer []byte
+	// head is set for HEAD requests, whose handlers usually write no body, so the declared Content-Length has to stand in for it
+	head bool
+}
+
+func (cw *compressWriter) CustomWriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+	// responses without a body have nothing to compress, so there is no reason to hold their headers back
+	if !bodyAllowed(status) {
+		cw.decided = true
+		cw.ResponseWriter.CustomWriteHeader(status)
+	}
+}
+
+func (cw *compressWriter) Write(data []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.CustomWriteHeader(response.StatusOK)
+	}
+	if cw.decided {
+		if cw.encoder != nil {
+			return cw.encoder.Write(data)
+		}
+		return cw.ResponseWriter.Write(data)
+	}
+	cw.buffer = append(cw.buffer, data...)
+	if len(cw.buffer) < minCompressSize {
+		return len(data), nil
+	}
+	if err := cw.decide(true); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// decide settles whether the body is compressed, sends the status and writes out whatever was buffered. large reports whether the body
+// reached minCompressSize.
+func (cw *compressWriter) decide(large bool) error {
+	cw.decided = true
+	h := cw.GetHeaders()
+	if large && cw.shouldCompress(h) {
+		cw.setEncoding(h)
+		cw.encoder = cw.compressor.pool.Get().(encoder)
+		cw.encoder.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.CustomWriteHeader(cw.status)
+
+	buffered := cw.buffer
+	cw.buffer = nil
+	if len(buffered) == 0 {
+		return nil
+	}
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(buffered)
+	} else {
+		_, err = cw.ResponseWriter.Write(buffered)
+	}
+	return err
+}
+
+// setEncoding changes the headers of the handler to describe the compressed body.
+func (cw *compressWriter) setEncoding(h *headers.Headers) {
+	h.Set("Content-Encoding", cw.compressor.encoding)
+	// the length the handler set is the one of the uncompressed body
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	// sidenote: the compressed body is a different sequence of bytes, so a strong validator of the uncompressed one would be a lie
+	if etag, ok := h.Get("ETag"); ok && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/" + etag)
+	}
+}
+
+// declaredLarge reports whether the handler declared a Content-Length of at least minCompressSize.
+func (cw *compressWriter) declaredLarge(h *headers.Headers) bool {
+	contentLength, _ := h.Get("Content-Length")
+	length, err := strconv.ParseInt(contentLength, 10, 64)
+	return err == nil && length >= minCompressSize
+}
+
+func (cw *compressWriter) shouldCompress(h *headers.Headers) bool {
+	if !bodyAllowed(cw.status) || cw.status == response.StatusPartialContent {
+		return false
+	}
+	if _, ok := h.Get("Content-Encoding"); ok {
+		return false
+	}
+	contentType, _ := h.Get("Content-Type")
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush sends what has been written so far, compressed or not, if the writer underneath can flush.
+func (cw *compressWriter) Flush() error {
+	if !cw.wroteHeader {
+		cw.CustomWriteHeader(response.StatusOK)
+	}
+	if !cw.decided {
+		if err := cw.decide(len(cw.buffer) > 0); err != nil {
+			return err
+		}
+	}
+	if cw.encoder != nil {
+		if err := cw.encoder.Flush(); err != nil {
+			return err
+		}
+	}
+	if flusher, ok := cw.ResponseWriter.(response.Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// Close writes out a body too small to compress, or ends the compressed stream, and returns the encoder to its pool.
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if !cw.wroteHeader && len(cw.buffer) == 0 {
+			return nil
+		}
+		// sidenote: a HEAD response has to describe the body a GET would get, so going by the length the handler declared it gets the same
+		// headers. There is no body to encode, so no encoder is set up.
+		if cw.head && len(cw.buffer) == 0 {
+			cw.decided = true
+			h := cw.GetHeaders()
+			if cw.declaredLarge(h) && cw.shouldCompress(h) {
+				cw.setEncoding(h)
+			}
+			cw.ResponseWriter.CustomWriteHeader(cw.status)
+			return nil
+		}
+		if err := cw.decide(false); err != nil {
+			return err
+		}
+	}
+	if cw.encoder == nil {
+		return nil
+	}
+	err := cw.encoder.Close()
+	cw.encoder.Reset(io.Discard)
+	cw.compressor.pool.Put(cw.encoder)
+	cw.encoder = nil
+	return err
+}
+
+// Hijack hands the connection over when the writer underneath allows it, so that compression applied to a whole mux doesn't get in the way of
+// a WebSocket upgrade. Nothing is compressed after that.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := cw.ResponseWriter.(response.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		cw.decided = true
+		cw.buffer = nil
+	}
+	return conn, rw, err
+}
+
+// bodyAllowed reports whether a response with this status may have a body. 1xx, 204 and 304 responses never do.
+func bodyAllowed(status int) bool {
+	return !(status >= 100 && status < 200) && status != response.StatusNoContent && status != response.StatusNotModified
+}
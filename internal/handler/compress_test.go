@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"github.com/juancruzfl/httpserver/internal/headers"
+	"github.com/juancruzfl/httpserver/internal/request"
+	"github.com/juancruzfl/httpserver/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var largeBody = strings.Repeat("compress me please, ", 200)
+
+func serveCompressed(h HandlerFunc, acceptEncoding string) *MockResponseWriter {
+	hs := headers.NewHeaders()
+	if acceptEncoding != "" {
+		hs.Set("Accept-Encoding", acceptEncoding)
+	}
+	r := request.NewMockRequest(request.NewMockRequestLine("1.1", "/", "GET"), *hs, nil, 0)
+	w := NewMockResponseWriter()
+	Chain(h, Compress(gzip.DefaultCompression)).ServeHttp(w, r)
+	return w
+}
+
+func writeBody(contentType string, body string) HandlerFunc {
+	return func(w response.ResponseWriter, r *request.Request) {
+		if contentType != "" {
+			w.GetHeaders().Set("Content-Type", contentType)
+		}
+		w.GetHeaders().Set("Content-Length", "4000")
+		w.GetHeaders().Set("ETag", "\"v1\"")
+		w.Write([]byte(body))
+	}
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	out, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return string(out)
+}
+
+func TestCompressGzip(t *testing.T) {
+	w := serveCompressed(writeBody("text/plain", largeBody), "gzip, deflate")
+	assert.Equal(t, 200, w.Status)
+	assert.Equal(t, "gzip", header(w, "Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", header(w, "Vary"))
+	_, hasLength := w.Headers.Get("Content-Length")
+	assert.False(t, hasLength, "the uncompressed Content-Length must not be sent")
+	assert.Equal(t, "W/\"v1\"", header(w, "ETag"))
+	assert.Less(t, len(w.Body), len(largeBody))
+	assert.Equal(t, largeBody, gunzip(t, w.Body))
+}
+
+func TestCompressDeflatePreferred(t *testing.T) {
+	w := serveCompressed(writeBody("text/plain", largeBody), "gzip;q=0.5, deflate;q=0.8")
+	assert.Equal(t, "deflate", header(w, "Content-Encoding"))
+	reader, err := zlib.NewReader(bytes.NewReader(w.Body))
+	require.NoError(t, err)
+	out, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, largeBody, string(out))
+}
+
+func TestCompressSkips(t *testing.T) {
+	cases := []struct {
+		name string
+		handler HandlerFunc
+		acceptEncoding string
+	}{
+		{"no Accept-Encoding", writeBody("text/plain", largeBody), ""},
+		{"gzip refused", writeBody("text/plain", largeBody), "gzip;q=0, deflate;q=0"},
+		{"identity only", writeBody("text/plain", largeBody), "identity"},
+		{"small body", writeBody("text/plain", "tiny"), "gzip"},
+		{"already compressed type", writeBody("image/png", largeBody), "gzip"},
+		{"own Content-Encoding", func(w response.ResponseWriter, r *request.Request) {
+			w.GetHeaders().Set("Content-Encoding", "br")
+			w.Write([]byte(largeBody))
+		}, "gzip"},
+	}
+	for _, c := range cases {
+		w := serveCompressed(c.handler, c.acceptEncoding)
+		encoding, _ := w.Headers.Get("Content-Encoding")
+		assert.NotEqual(t, "gzip", encoding, c.name)
+		assert.True(t, string(w.Body) == largeBody || string(w.Body) == "tiny", c.name)
+		assert.Equal(t, "Accept-Encoding", header(w, "Vary"), c.name)
+	}
+}
+
+func TestCompressWildcard(t *testing.T) {
+	assert.Equal(t, "gzip", header(serveCompressed(writeBody("", largeBody), "*"), "Content-Encoding"))
+	assert.Equal(t, "deflate", header(serveCompressed(writeBody("", largeBody), "gzip;q=0, *"), "Content-Encoding"))
+}
+
+func TestCompressManySmallWrites(t *testing.T) {
+	w := serveCompressed(func(w response.ResponseWriter, r *request.Request) {
+		for i := 0; i < 200; i++ {
+			w.Write([]byte("compress me please, "))
+		}
+	}, "gzip")
+	assert.Equal(t, "gzip", header(w, "Content-Encoding"))
+	assert.Equal(t, largeBody, gunzip(t, w.Body))
+}
+
+func TestCompressHead(t *testing.T) {
+	// a FileServer answers HEAD with the headers of the file and no body, which must come out the same as for GET
+	fs := FileServer(fstest.MapFS{"page.html": {Data: []byte(largeBody), ModTime: modTime}})
+	serve := func(method string) *MockResponseWriter {
+		hs := headers.NewHeaders()
+		hs.Set("Accept-Encoding", "gzip")
+		r := request.NewMockRequest(request.NewMockRequestLine("1.1", "/page.html", method), *hs, nil, 0)
+		r.SetPathValue("path", "page.html")
+		w := NewMockResponseWriter()
+		Chain(fs, Compress(gzip.DefaultCompression)).ServeHttp(w, r)
+		return w
+	}
+	get, head := serve("GET"), serve("HEAD")
+	assert.Equal(t, largeBody, gunzip(t, get.Body))
+	for _, name := range []string{"Content-Encoding", "Content-Length", "Accept-Ranges", "ETag", "Content-Type", "Vary"} {
+		assert.Equal(t, header(get, name), header(head, name), name)
+	}
+	assert.Equal(t, "gzip", header(head, "Content-Encoding"))
+	assert.True(t, strings.HasPrefix(header(head, "ETag"), "W/"))
+	_, hasLength := head.Headers.Get("Content-Length")
+	assert.False(t, hasLength)
+	assert.Empty(t, head.Body)
+
+	// a small or already compressed body is left alone on HEAD as well
+	small := func(w response.ResponseWriter, r *request.Request) {
+		w.GetHeaders().Set("Content-Length", "10")
+		w.CustomWriteHeader(response.StatusOK)
+	}
+	image := func(w response.ResponseWriter, r *request.Request) {
+		w.GetHeaders().Set("Content-Type", "image/png")
+		w.GetHeaders().Set("Content-Length", "4000")
+		w.CustomWriteHeader(response.StatusOK)
+	}
+	for _, h := range []HandlerFunc{small, image} {
+		hs := headers.NewHeaders()
+		hs.Set("Accept-Encoding", "gzip")
+		r := request.NewMockRequest(request.NewMockRequestLine("1.1", "/", "HEAD"), *hs, nil, 0)
+		w := NewMockResponseWriter()
+		Chain(h, Compress(gzip.DefaultCompression)).ServeHttp(w, r)
+		_, encoded := w.Headers.Get("Content-Encoding")
+		assert.False(t, encoded)
+		assert.NotEmpty(t, header(w, "Content-Length"))
+	}
+}
+
+func TestCompressNoBodyStatus(t *testing.T) {
+	w := serveCompressed(func(w response.ResponseWriter, r *request.Request) {
+		w.CustomWriteHeader(response.StatusNoContent)
+	}, "gzip")
+	assert.Equal(t, 204, w.Status)
+	_, ok := w.Headers.Get("Content-Encoding")
+	assert.False(t, ok)
+}
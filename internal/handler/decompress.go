@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strings"
+	"github.com/juancruzfl/httpserver/internal/request"
+	"github.com/juancruzfl/httpserver/internal/response"
+)
+
+// Decompress returns middleware that transparently decodes request bodies sent with Content-Encoding gzip or deflate, so the handler reads the
+// original bytes from BodyReader (and Body, ReadBody and the form methods with it). maxBytes caps the decoded body. Going over it fails the read
+// with a *request.MaxBytesError and answers with a 413, like a body over the server's own limit. A request with an encoding the server can't
+// decode gets a 415 Unsupported Media Type listing the ones it can in Accept-Encoding, and a body that isn't valid for its encoding a 400.
+//
+// sidenote: the size limit of the server only sees the compressed bytes, and a few kilobytes of gzip can expand to gigabytes. That is why the limit
+// here is required and applies to what comes out of the decoder.
+func Decompress(maxBytes int64) Middleware {
+	if maxBytes <= 0 {
+		panic("Decompress needs a positive size limit")
+	}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w response.ResponseWriter, r *request.Request) {
+			codings, ok := contentCodings(r)
+			if !ok {
+				w.GetHeaders().Set("Accept-Encoding", "gzip, deflate")
+				sendError(w, response.StatusUnsupportedMediaType)
+				return
+			}
+			if len(codings) == 0 {
+				next.ServeHttp(w, r)
+				return
+			}
+
+			var body io.ReadCloser = r.BodyReader
+			if body == nil {
+				body = io.NopCloser(bytes.NewReader(r.Body))
+			}
+			decoded := &decodedBody{Reader: body, closers: []io.Closer{body}}
+			// codings are listed in the order they were applied, so they come off in reverse
+			for i := len(codings) - 1; i >= 0; i-- {
+				reader, err := newDecoder(codings[i], decoded.Reader)
+				if errors.Is(err, io.EOF) {
+					// an empty body decodes to an empty body
+					decoded.Reader = bytes.NewReader(nil)
+					break
+				}
+				if err != nil {
+					decoded.Close()
+					sendError(w, response.StatusBadRequest)
+					return
+				}
+				decoded.Reader = reader
+				decoded.closers = append(decoded.closers, reader)
+			}
+
+			// the headers now describe the decoded body, which has no known length
+			r.Headers.Del("Content-Encoding")
+			r.Headers.Del("Content-Length")
+			r.Body = nil
+			r.BodyReader = response.MaxBytesReader(w, decoded, maxBytes)
+			next.ServeHttp(w, r)
+		})
+	}
+}
+
+// contentCodings returns the codings of Content-Encoding in the order they were applied, leaving out identity. ok is false when one of them
+// can't be decoded.
+func contentCodings(r *request.Request) ([]string, bool) {
+	var codings []string
+	for _, value := range r.Headers.Values("Content-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			switch coding {
+			case "", "identity":
+			case "gzip", "x-gzip", "deflate":
+				codings = append(codings, coding)
+			default:
+				return nil, false
+			}
+		}
+	}
+	return codings, true
+}
+
+// newDecoder wraps r in a reader for the coding. A gzip header is read right away, so a body that isn't gzip at all fails here.
+func newDecoder(coding string, r io.Reader) (io.ReadCloser, error) {
+	if coding != "deflate" {
+		return gzip.NewReader(r)
+	}
+	// sidenote: "deflate" is meant to be a zlib stream, but enough clients send raw deflate data that we accept both. A zlib stream starts
+	// with a two byte header whose first nibble names the deflate method and which, read as a big endian number, is a multiple of 31.
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(2)
+	if len(header) == 0 {
+		return nil, err
+	}
+	if len(header) == 2 && header[0] & 0x0f == 8 && (uint16(header[0]) << 8 | uint16(header[1])) % 31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+// decodedBody reads through the chain of decoders and, once closed, closes every one of them along with the body underneath.
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *decodedBody) Close() error {
+	var first error
+	for i := len(d.closers) - 1; i >= 0; i-- {
+		if err := d.closers[i].Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
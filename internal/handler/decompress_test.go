@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"github.com/juancruzfl/httpserver/internal/headers"
+	"github.com/juancruzfl/httpserver/internal/request"
+	"github.com/juancruzfl/httpserver/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compressBody(t *testing.T, coding string, data []byte) []byte {
+	var buffer bytes.Buffer
+	var w io.WriteCloser
+	switch coding {
+	case "gzip":
+		w = gzip.NewWriter(&buffer)
+	case "deflate":
+		w = zlib.NewWriter(&buffer)
+	case "raw":
+		fw, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+		require.NoError(t, err)
+		w = fw
+	}
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buffer.Bytes()
+}
+
+// echoBody answers with the body the handler reads, or with a 400 and the error when the read fails.
+func echoBody(w response.ResponseWriter, r *request.Request) {
+	body, err := io.ReadAll(r.BodyReader)
+	if err != nil {
+		var maxErr *request.MaxBytesError
+		if !errors.As(err, &maxErr) {
+			w.CustomWriteHeader(response.StatusBadRequest)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(body)
+}
+
+func serveDecompressed(contentEncoding string, body []byte, maxBytes int64) *MockResponseWriter {
+	hs := headers.NewHeaders()
+	if contentEncoding != "" {
+		hs.Set("Content-Encoding", contentEncoding)
+	}
+	r := request.NewMockRequest(request.NewMockRequestLine("1.1", "/", "POST"), *hs, body, len(body))
+	w := NewMockResponseWriter()
+	Chain(HandlerFunc(echoBody), Decompress(maxBytes)).ServeHttp(w, r)
+	return w
+}
+
+func TestDecompressBodies(t *testing.T) {
+	original := []byte(strings.Repeat("uploaded data ", 100))
+	cases := []struct {
+		name string
+		contentEncoding string
+		body []byte
+	}{
+		{"gzip", "gzip", compressBody(t, "gzip", original)},
+		{"x-gzip", "X-GZIP", compressBody(t, "gzip", original)},
+		{"zlib deflate", "deflate", compressBody(t, "deflate", original)},
+		{"raw deflate", "deflate", compressBody(t, "raw", original)},
+		{"stacked", "deflate, gzip", compressBody(t, "gzip", compressBody(t, "deflate", original))},
+		{"identity", "identity", original},
+		{"none", "", original},
+	}
+	for _, c := range cases {
+		w := serveDecompressed(c.contentEncoding, c.body, 1 << 20)
+		assert.Equal(t, 0, w.Status, c.name)
+		assert.Equal(t, string(original), string(w.Body), c.name)
+	}
+}
+
+func TestDecompressRewritesHeaders(t *testing.T) {
+	hs := headers.NewHeaders()
+	hs.Set("Content-Encoding", "gzip")
+	body := compressBody(t, "gzip", []byte("hello"))
+	r := request.NewMockRequest(request.NewMockRequestLine("1.1", "/", "POST"), *hs, body, len(body))
+	r.Headers.Set("Content-Length", "25")
+	w := NewMockResponseWriter()
+	Chain(HandlerFunc(func(w response.ResponseWriter, r *request.Request) {
+		_, hasEncoding := r.Headers.Get("Content-Encoding")
+		_, hasLength := r.Headers.Get("Content-Length")
+		assert.False(t, hasEncoding)
+		assert.False(t, hasLength)
+		data, err := r.ReadBody()
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+	}), Decompress(1024)).ServeHttp(w, r)
+}
+
+func TestDecompressEmptyBody(t *testing.T) {
+	for _, coding := range []string{"gzip", "deflate"} {
+		w := serveDecompressed(coding, nil, 1024)
+		assert.Equal(t, 0, w.Status, coding)
+		assert.Empty(t, w.Body, coding)
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	// a kilobyte of zeros compresses to almost nothing, which is exactly what a decompression bomb relies on
+	bomb := compressBody(t, "gzip", make([]byte, 1 << 20))
+	w := serveDecompressed("gzip", bomb, 1024)
+	assert.Equal(t, response.StatusContentTooLarge, w.Status)
+	assert.Contains(t, string(w.Body), "limit is 1024 bytes")
+
+	w = serveDecompressed("gzip", compressBody(t, "gzip", make([]byte, 1024)), 1024)
+	assert.Equal(t, 0, w.Status)
+	assert.Len(t, w.Body, 1024)
+}
+
+func TestDecompressUnsupportedEncoding(t *testing.T) {
+	w := serveDecompressed("br", []byte("whatever"), 1024)
+	assert.Equal(t, response.StatusUnsupportedMediaType, w.Status)
+	assert.Equal(t, "gzip, deflate", header(w, "Accept-Encoding"))
+
+	w = serveDecompressed("gzip, compress", []byte("whatever"), 1024)
+	assert.Equal(t, response.StatusUnsupportedMediaType, w.Status)
+}
+
+func TestDecompressMalformedBody(t *testing.T) {
+	w := serveDecompressed("gzip", []byte("this is not gzip"), 1024)
+	assert.Equal(t, response.StatusBadRequest, w.Status)
+
+	// a valid header followed by garbage only fails once the handler reads it
+	corrupt := compressBody(t, "gzip", []byte(strings.Repeat("data ", 100)))
+	corrupt = append(corrupt[:20], bytes.Repeat([]byte{0xff}, 20)...)
+	w = serveDecompressed("gzip", corrupt, 1024)
+	assert.Equal(t, response.StatusBadRequest, w.Status)
+}
+
+func TestDecompressRequiresLimit(t *testing.T) {
+	assert.Panics(t, func() { Decompress(0) })
+}
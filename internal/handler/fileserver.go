@@ -0,0 +1,530 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"github.com/juancruzfl/httpserver/internal/headers"
+	"github.com/juancruzfl/httpserver/internal/request"
+	"github.com/juancruzfl/httpserver/internal/response"
+)
+
+// FileHandler serves the files of a file system, see FileServer.
+type FileHandler struct {
+	FS fs.FS
+	// Wildcard names the catch-all of the route pattern that holds the file path, "path" by default as in "/static/{path...}". On a route
+	// without that wildcard the whole request path is used.
+	Wildcard string
+	// DirectoryListing renders an HTML index of directories that have no index.html. Without it such directories are answered with a 404.
+	DirectoryListing bool
+}
+
+// FileServer returns a handler serving the files of fsys, e.g. mux.Handle("GET", "/static/{path...}", handler.FileServer(os.DirFS("public"))).
+// It answers Range requests with 206 Partial Content (multipart/byteranges for several ranges), sends Last-Modified and ETag, and answers
+// conditional requests with 304 Not Modified or 412 Precondition Failed.
+func FileServer(fsys fs.FS) *FileHandler {
+	return &FileHandler{FS: fsys}
+}
+
+// sniffLen is how much of a file is looked at to guess its content type when the extension doesn't tell.
+const sniffLen = 512
+
+// maxRanges caps the number of ranges in a single request. Asking for many small or overlapping ranges is a cheap way to make a server do a lot
+// of work for a small request, so past that (or past the size of the file in total) the whole file is sent instead.
+const maxRanges = 64
+
+func (f *FileHandler) ServeHttp(w response.ResponseWriter, r *request.Request) {
+	method := r.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		w.GetHeaders().Set("Allow", "GET, HEAD")
+		sendError(w, response.StatusMethodNotAllowed)
+		return
+	}
+
+	name, ok := f.fileName(r)
+	if !ok {
+		sendError(w, response.StatusBadRequest)
+		return
+	}
+	file, info, status := openFile(f.FS, name)
+	if status != 0 {
+		sendError(w, status)
+		return
+	}
+	defer file.Close()
+
+	if info.IsDir() {
+		// sidenote: relative links in an index page only resolve against the directory if its URL ends with a slash, so we redirect to that URL
+		// first, the same way every web server does
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			// Path is decoded, so a directory named "a b" or "#1" has to be escaped again to make a URI of it
+			target := escapePath(r.URL.Path) + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			w.GetHeaders().Set("Location", target)
+			sendError(w, response.StatusMovedPermanently)
+			return
+		}
+		index, indexInfo, status := openFile(f.FS, path.Join(name, "index.html"))
+		if status == 0 && !indexInfo.IsDir() {
+			defer index.Close()
+			serveContent(w, r, index, indexInfo)
+			return
+		}
+		if !f.DirectoryListing {
+			sendError(w, response.StatusNotFound)
+			return
+		}
+		f.serveListing(w, r, name)
+		return
+	}
+	serveContent(w, r, file, info)
+}
+
+// fileName maps the request to a name in the file system. The path has already been decoded and cleaned of ".." segments by the parser, but we
+// check it against the rules of fs.FS again rather than rely on that.
+func (f *FileHandler) fileName(r *request.Request) (string, bool) {
+	wildcard := f.Wildcard
+	if wildcard == "" {
+		wildcard = "path"
+	}
+	name, ok := r.LookupPathValue(wildcard)
+	if !ok {
+		name = r.URL.Path
+	}
+	if strings.ContainsAny(name, "\\\x00") {
+		return "", false
+	}
+	name = strings.TrimPrefix(path.Clean("/" + name), "/")
+	if name == "" {
+		name = "."
+	}
+	return name, fs.ValidPath(name)
+}
+
+func openFile(fsys fs.FS, name string) (fs.File, fs.FileInfo, int) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, nil, statusForFSError(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, statusForFSError(err)
+	}
+	return file, info, 0
+}
+
+func statusForFSError(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrInvalid):
+		return response.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return response.StatusForbidden
+	}
+	return response.StatusInternalServerError
+}
+
+func sendError(w response.ResponseWriter, status int) {
+	w.GetHeaders().Set("Content-Type", "text/plain; charset=utf-8")
+	w.CustomWriteHeader(status)
+	w.Write([]byte(fmt.Sprintf("%d %s", status, response.StatusText(status))))
+}
+
+// serveContent answers a request for a regular file: conditional requests first, then ranges, then the file itself.
+func serveContent(w response.ResponseWriter, r *request.Request, file fs.File, info fs.FileInfo) {
+	h := w.GetHeaders()
+	modTime := info.ModTime().UTC().Truncate(time.Second)
+	etag := fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
+	if knownTime(modTime) {
+		h.Set("Last-Modified", modTime.Format(headers.TimeFormat))
+	}
+	h.Set("ETag", etag)
+
+	if status := checkPreconditions(r, etag, modTime); status != 0 {
+		if status == response.StatusNotModified {
+			h.Del("Content-Type")
+			w.CustomWriteHeader(status)
+			return
+		}
+		sendError(w, status)
+		return
+	}
+
+	contentType, prefix, err := detectContentType(file, info.Name())
+	if err != nil {
+		sendError(w, response.StatusInternalServerError)
+		return
+	}
+	h.Set("Content-Type", contentType)
+
+	size := info.Size()
+	seeker, canSeek := file.(io.Seeker)
+	if canSeek {
+		h.Set("Accept-Ranges", "bytes")
+	}
+	rangeHeader, hasRange := r.Headers.Get("Range")
+	if hasRange && canSeek && rangeApplies(r, etag, modTime) {
+		ranges, err := parseRange(rangeHeader, size)
+		if errors.Is(err, errUnsatisfiableRange) {
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			sendError(w, response.StatusRangeNotSatisfiable)
+			return
+		}
+		if err == nil && len(ranges) > 0 && sumRanges(ranges) <= size {
+			serveRanges(w, r, file, seeker, ranges, size, contentType)
+			return
+		}
+	}
+
+	h.Set("Content-Length", strconv.FormatInt(size, 10))
+	w.CustomWriteHeader(response.StatusOK)
+	if r.RequestLine.Method == "HEAD" {
+		return
+	}
+	w.Write(prefix)
+	io.Copy(w, file)
+}
+
+// checkPreconditions evaluates the conditional headers in the order RFC 9110 section 13.2.2 gives, returning 304 or 412 when the request
+// shouldn't be answered with the file, or 0 when it should.
+func checkPreconditions(r *request.Request, etag string, modTime time.Time) int {
+	if match, ok := r.Headers.Get("If-Match"); ok {
+		if !etagMatches(match, etag, false) {
+			return response.StatusPreconditionFailed
+		}
+	} else if since, ok := r.Headers.Get("If-Unmodified-Since"); ok && knownTime(modTime) {
+		if t, err := headers.ParseTime(since); err == nil && modTime.After(t) {
+			return response.StatusPreconditionFailed
+		}
+	}
+
+	if noneMatch, ok := r.Headers.Get("If-None-Match"); ok {
+		if etagMatches(noneMatch, etag, true) {
+			return response.StatusNotModified
+		}
+	} else if since, ok := r.Headers.Get("If-Modified-Since"); ok && knownTime(modTime) {
+		if t, err := headers.ParseTime(since); err == nil && !modTime.After(t) {
+			return response.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// rangeApplies checks If-Range: the ranges are only sent if the file is still the one the client has the rest of.
+func rangeApplies(r *request.Request, etag string, modTime time.Time) bool {
+	ifRange, ok := r.Headers.Get("If-Range")
+	if !ok {
+		return true
+	}
+	ifRange = strings.TrimSpace(ifRange)
+	if strings.HasPrefix(ifRange, "\"") || strings.HasPrefix(ifRange, "W/") {
+		return etagMatches(ifRange, etag, false)
+	}
+	t, err := headers.ParseTime(ifRange)
+	return err == nil && knownTime(modTime) && t.Equal(modTime)
+}
+
+// knownTime reports whether the file system gave us a real modification time. Dates can only be compared against one.
+func knownTime(t time.Time) bool {
+	return t.Unix() > 0
+}
+
+// etagMatches reports whether the list of entity tags in a conditional header matches etag. Weak comparison ignores the W/ prefix, strong
+// comparison never matches a weak tag.
+func etagMatches(list string, etag string, weak bool) bool {
+	list = strings.TrimSpace(list)
+	if list == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// detectContentType picks the content type from the extension, falling back to looking at the start of the file. The bytes read to sniff are
+// returned so they don't have to be read again.
+func detectContentType(file fs.File, name string) (string, []byte, error) {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType, nil, nil
+	}
+	buffer := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	buffer = buffer[:n]
+	// sidenote: a file we sniffed has been read from, so for range requests it has to be rewound. Files that can't seek don't get ranges anyway.
+	if seeker, ok := file.(io.Seeker); ok {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return "", nil, err
+		}
+		return sniff(buffer), nil, nil
+	}
+	return sniff(buffer), buffer, nil
+}
+
+var signatures = []struct {
+	prefix string
+	contentType string
+}{
+	{"\x89PNG\r\n\x1a\n", "image/png"},
+	{"\xff\xd8\xff", "image/jpeg"},
+	{"GIF87a", "image/gif"},
+	{"GIF89a", "image/gif"},
+	{"%PDF-", "application/pdf"},
+	{"PK\x03\x04", "application/zip"},
+	{"\x1f\x8b\x08", "application/gzip"},
+	{"<!DOCTYPE html", "text/html; charset=utf-8"},
+	{"<!doctype html", "text/html; charset=utf-8"},
+	{"<html", "text/html; charset=utf-8"},
+}
+
+// sniff guesses a content type from the first bytes of a file: a few well known signatures, then text if it is valid UTF-8 without control
+// characters, and binary otherwise.
+func sniff(data []byte) string {
+	trimmed := strings.TrimLeft(string(data), " \t\r\n")
+	for _, signature := range signatures {
+		if strings.HasPrefix(trimmed, signature.prefix) {
+			return signature.contentType
+		}
+	}
+	// the last character may have been cut in half by the sniff limit
+	text := data
+	if len(text) == sniffLen {
+		for i := 0; i < utf8.UTFMax && len(text) > 0 && !utf8.Valid(text); i++ {
+			text = text[:len(text) - 1]
+		}
+	}
+	if !utf8.Valid(text) {
+		return "application/octet-stream"
+	}
+	for _, c := range text {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' && c != '\f' {
+			return "application/octet-stream"
+		}
+	}
+	return "text/plain; charset=utf-8"
+}
+
+type byteRange struct {
+	start int64
+	length int64
+}
+
+func (b byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", b.start, b.start + b.length - 1, size)
+}
+
+var errUnsatisfiableRange = errors.New("No range overlaps the file")
+
+// parseRange parses a Range header ("bytes=0-99,200-,-50") against a file of the given size. Ranges past the end of the file are dropped, and
+// errUnsatisfiableRange is returned if none are left. Any other error means the header should be ignored.
+func parseRange(value string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(value), "bytes=")
+	if !ok {
+		return nil, errors.New("Unsupported range unit")
+	}
+	parts := strings.Split(spec, ",")
+	if len(parts) > maxRanges {
+		return nil, errors.New("Too many ranges")
+	}
+	var ranges []byteRange
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("Invalid range %q", part)
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		if first == "" {
+			// a suffix range, the last n bytes of the file
+			n, err := parseRangeNumber(last)
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			ranges = append(ranges, byteRange{start: size - n, length: n})
+			continue
+		}
+		start, err := parseRangeNumber(first)
+		if err != nil {
+			return nil, err
+		}
+		end := size - 1
+		if last != "" {
+			if end, err = parseRangeNumber(last); err != nil {
+				return nil, err
+			}
+			if end < start {
+				return nil, fmt.Errorf("Invalid range %q", part)
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+func parseRangeNumber(s string) (int64, error) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, fmt.Errorf("Invalid range position %q", s)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func sumRanges(ranges []byteRange) int64 {
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	return total
+}
+
+// serveRanges sends a 206 with a single range as it is, or several of them as a multipart/byteranges body.
+func serveRanges(w response.ResponseWriter, r *request.Request, file fs.File, seeker io.Seeker, ranges []byteRange, size int64, contentType string) {
+	h := w.GetHeaders()
+	if len(ranges) == 1 {
+		h.Set("Content-Range", ranges[0].contentRange(size))
+		h.Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+		w.CustomWriteHeader(response.StatusPartialContent)
+		if r.RequestLine.Method != "HEAD" {
+			copyRange(w, file, seeker, ranges[0])
+		}
+		return
+	}
+
+	boundary := randomBoundary()
+	parts := make([]string, len(ranges))
+	length := int64(len("\r\n--" + boundary + "--\r\n"))
+	for i, br := range ranges {
+		parts[i] = fmt.Sprintf("\r\n--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", boundary, contentType, br.contentRange(size))
+		length += int64(len(parts[i])) + br.length
+	}
+	h.Set("Content-Type", "multipart/byteranges; boundary=" + boundary)
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	w.CustomWriteHeader(response.StatusPartialContent)
+	if r.RequestLine.Method == "HEAD" {
+		return
+	}
+	for i, br := range ranges {
+		io.WriteString(w, parts[i])
+		if !copyRange(w, file, seeker, br) {
+			return
+		}
+	}
+	io.WriteString(w, "\r\n--" + boundary + "--\r\n")
+}
+
+func copyRange(w io.Writer, file fs.File, seeker io.Seeker, br byteRange) bool {
+	if _, err := seeker.Seek(br.start, io.SeekStart); err != nil {
+		return false
+	}
+	_, err := io.CopyN(w, file, br.length)
+	return err == nil
+}
+
+func randomBoundary() string {
+	buffer := make([]byte, 16)
+	rand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
+
+// serveListing renders an HTML page linking to every entry of the directory, subdirectories first.
+func (f *FileHandler) serveListing(w response.ResponseWriter, r *request.Request, name string) {
+	entries, err := fs.ReadDir(f.FS, name)
+	if err != nil {
+		sendError(w, statusForFSError(err))
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir() != entries[j].IsDir() {
+			return entries[i].IsDir()
+		}
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	var page strings.Builder
+	title := html.EscapeString(r.URL.Path)
+	page.WriteString("<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"><title>Index of " + title + "</title></head>\n<body>\n")
+	page.WriteString("<h1>Index of " + title + "</h1>\n<ul>\n")
+	if name != "." {
+		page.WriteString("<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, entry := range entries {
+		display := entry.Name()
+		if entry.IsDir() {
+			display += "/"
+		}
+		page.WriteString("<li><a href=\"" + html.EscapeString(escapePathSegment(display)) + "\">" + html.EscapeString(display) + "</a></li>\n")
+	}
+	page.WriteString("</ul>\n</body>\n</html>\n")
+
+	w.GetHeaders().Set("Content-Type", "text/html; charset=utf-8")
+	w.CustomWriteHeader(response.StatusOK)
+	if r.RequestLine.Method != "HEAD" {
+		w.Write([]byte(page.String()))
+	}
+}
+
+// escapePath escapes every segment of a decoded path, keeping the slashes between them.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = escapePathSegment(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// escapePathSegment percent-encodes a file name for use in a relative link, leaving only unreserved characters and a trailing slash as they are.
+// Without it a file named "a?b" or "#1" would link somewhere else entirely.
+func escapePathSegment(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '.' || c == '_' || c == '~' || (c == '/' && i == len(s) - 1) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
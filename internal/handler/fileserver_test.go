@@ -0,0 +1,199 @@
+package handler
+
+import (
+	iofs "io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+	"github.com/juancruzfl/httpserver/internal/headers"
+	"github.com/juancruzfl/httpserver/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var modTime = time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+func testFS() fstest.MapFS {
+	return fstest.MapFS{
+		"hello.txt": {Data: []byte("Hello, World!"), ModTime: modTime},
+		"app.js": {Data: []byte("console.log(1)"), ModTime: modTime},
+		"noext": {Data: []byte("\x89PNG\r\n\x1a\nrest"), ModTime: modTime},
+		"docs/index.html": {Data: []byte("<h1>docs</h1>"), ModTime: modTime},
+		"files/b file.txt": {Data: []byte("b"), ModTime: modTime},
+		"files/a.txt": {Data: []byte("a"), ModTime: modTime},
+		"files/sub/c.txt": {Data: []byte("c"), ModTime: modTime},
+		"files/<script>.txt": {Data: []byte("x"), ModTime: modTime},
+	}
+}
+
+// serveFile runs the handler as if it was mounted on "/static/{path...}".
+func serveFile(h Handler, method string, filePath string, header ...string) *MockResponseWriter {
+	hs := headers.NewHeaders()
+	for i := 0; i + 1 < len(header); i += 2 {
+		hs.Set(header[i], header[i + 1])
+	}
+	r := request.NewMockRequest(request.NewMockRequestLine("1.1", "/static/" + filePath, method), *hs, nil, 0)
+	r.SetPathValue("path", filePath)
+	w := NewMockResponseWriter()
+	h.ServeHttp(w, r)
+	return w
+}
+
+func header(w *MockResponseWriter, name string) string {
+	value, _ := w.Headers.Get(name)
+	return value
+}
+
+func TestFileServerServesFiles(t *testing.T) {
+	fs := FileServer(testFS())
+
+	w := serveFile(fs, "GET", "hello.txt")
+	assert.Equal(t, 200, w.Status)
+	assert.Equal(t, "Hello, World!", string(w.Body))
+	assert.Equal(t, "text/plain; charset=utf-8", header(w, "Content-Type"))
+	assert.Equal(t, "13", header(w, "Content-Length"))
+	assert.Equal(t, "Fri, 01 Mar 2024 12:00:00 GMT", header(w, "Last-Modified"))
+	assert.NotEmpty(t, header(w, "ETag"))
+	assert.Equal(t, "bytes", header(w, "Accept-Ranges"))
+
+	assert.Contains(t, header(serveFile(fs, "GET", "app.js"), "Content-Type"), "javascript")
+	assert.Equal(t, "image/png", header(serveFile(fs, "GET", "noext"), "Content-Type"))
+
+	w = serveFile(fs, "HEAD", "hello.txt")
+	assert.Equal(t, 200, w.Status)
+	assert.Empty(t, w.Body)
+	assert.Equal(t, "13", header(w, "Content-Length"))
+}
+
+func TestFileServerRejectsTraversal(t *testing.T) {
+	// the handler only sees docs/, so hello.txt sits just outside of it
+	docs, err := iofs.Sub(testFS(), "docs")
+	require.NoError(t, err)
+	fs := FileServer(docs)
+	for _, name := range []string{"../hello.txt", "index.html/../../hello.txt", "..\\hello.txt", "a\x00b"} {
+		w := serveFile(fs, "GET", name)
+		assert.NotEqual(t, 200, w.Status, name)
+		assert.NotContains(t, string(w.Body), "Hello, World!", name)
+	}
+	// ".." that stays inside the file system resolves normally
+	assert.Equal(t, "Hello, World!", string(serveFile(FileServer(testFS()), "GET", "docs/../hello.txt").Body))
+}
+
+func TestFileServerDirectories(t *testing.T) {
+	fs := FileServer(testFS())
+
+	w := serveFile(fs, "GET", "docs")
+	assert.Equal(t, 301, w.Status)
+	assert.Equal(t, "/static/docs/", header(w, "Location"))
+
+	w = serveFile(fs, "GET", "docs/")
+	assert.Equal(t, 200, w.Status)
+	assert.Equal(t, "<h1>docs</h1>", string(w.Body))
+
+	assert.Equal(t, 404, serveFile(fs, "GET", "files/").Status)
+
+	fs.DirectoryListing = true
+	w = serveFile(fs, "GET", "files/")
+	assert.Equal(t, 200, w.Status)
+	body := string(w.Body)
+	assert.Contains(t, body, `<a href="sub/">sub/</a>`)
+	assert.Contains(t, body, `<a href="b%20file.txt">b file.txt</a>`)
+	assert.Contains(t, body, `&lt;script&gt;.txt`)
+	assert.NotContains(t, body, "<script>")
+	assert.Less(t, strings.Index(body, "sub/"), strings.Index(body, "a.txt"), "directories should come first")
+
+	// the redirect of a directory whose name needs escaping is still a valid URI for it
+	odd := FileServer(fstest.MapFS{"a b/x?y/#1/index.html": {Data: []byte("odd"), ModTime: modTime}})
+	r := request.NewMockRequest(request.NewMockRequestLine("1.1", "/static/a%20b/x%3Fy/%231?page=2", "GET"), *headers.NewHeaders(), nil, 0)
+	r.SetPathValue("path", "a b/x?y/#1")
+	w = NewMockResponseWriter()
+	odd.ServeHttp(w, r)
+	assert.Equal(t, 301, w.Status)
+	assert.Equal(t, "/static/a%20b/x%3Fy/%231/?page=2", header(w, "Location"))
+}
+
+func TestFileServerConditionalRequests(t *testing.T) {
+	fs := FileServer(testFS())
+	etag := header(serveFile(fs, "GET", "hello.txt"), "ETag")
+
+	w := serveFile(fs, "GET", "hello.txt", "If-None-Match", "\"other\", " + etag)
+	assert.Equal(t, 304, w.Status)
+	assert.Empty(t, w.Body)
+	assert.Equal(t, etag, header(w, "ETag"))
+
+	assert.Equal(t, 304, serveFile(fs, "GET", "hello.txt", "If-None-Match", "W/" + etag).Status)
+	assert.Equal(t, 304, serveFile(fs, "GET", "hello.txt", "If-Modified-Since", "Fri, 01 Mar 2024 12:00:00 GMT").Status)
+	assert.Equal(t, 200, serveFile(fs, "GET", "hello.txt", "If-Modified-Since", "Thu, 29 Feb 2024 12:00:00 GMT").Status)
+	// If-None-Match wins over If-Modified-Since
+	assert.Equal(t, 200, serveFile(fs, "GET", "hello.txt", "If-None-Match", "\"other\"", "If-Modified-Since", "Fri, 01 Mar 2024 12:00:00 GMT").Status)
+
+	assert.Equal(t, 412, serveFile(fs, "GET", "hello.txt", "If-Match", "\"other\"").Status)
+	assert.Equal(t, 200, serveFile(fs, "GET", "hello.txt", "If-Match", etag).Status)
+	assert.Equal(t, 412, serveFile(fs, "GET", "hello.txt", "If-Unmodified-Since", "Thu, 29 Feb 2024 12:00:00 GMT").Status)
+}
+
+func TestFileServerRanges(t *testing.T) {
+	fs := FileServer(testFS())
+
+	w := serveFile(fs, "GET", "hello.txt", "Range", "bytes=0-4")
+	assert.Equal(t, 206, w.Status)
+	assert.Equal(t, "Hello", string(w.Body))
+	assert.Equal(t, "bytes 0-4/13", header(w, "Content-Range"))
+	assert.Equal(t, "5", header(w, "Content-Length"))
+
+	w = serveFile(fs, "GET", "hello.txt", "Range", "bytes=-6")
+	assert.Equal(t, "World!", string(w.Body))
+	w = serveFile(fs, "GET", "hello.txt", "Range", "bytes=7-100")
+	assert.Equal(t, "World!", string(w.Body))
+	assert.Equal(t, "bytes 7-12/13", header(w, "Content-Range"))
+
+	w = serveFile(fs, "GET", "hello.txt", "Range", "bytes=20-")
+	assert.Equal(t, 416, w.Status)
+	assert.Equal(t, "bytes */13", header(w, "Content-Range"))
+
+	// a header we can't make sense of is ignored
+	w = serveFile(fs, "GET", "hello.txt", "Range", "lines=1-2")
+	assert.Equal(t, 200, w.Status)
+	assert.Equal(t, "Hello, World!", string(w.Body))
+}
+
+func TestFileServerMultipleRanges(t *testing.T) {
+	w := serveFile(FileServer(testFS()), "GET", "hello.txt", "Range", "bytes=0-1, 7-8")
+	assert.Equal(t, 206, w.Status)
+	contentType := header(w, "Content-Type")
+	require.True(t, strings.HasPrefix(contentType, "multipart/byteranges; boundary="), contentType)
+	boundary := strings.TrimPrefix(contentType, "multipart/byteranges; boundary=")
+
+	expected := "\r\n--" + boundary + "\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Range: bytes 0-1/13\r\n\r\nHe" +
+		"\r\n--" + boundary + "\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Range: bytes 7-8/13\r\n\r\nWo" +
+		"\r\n--" + boundary + "--\r\n"
+	assert.Equal(t, expected, string(w.Body))
+	assert.Equal(t, len(expected), atoi(t, header(w, "Content-Length")))
+}
+
+func TestFileServerIfRange(t *testing.T) {
+	fs := FileServer(testFS())
+	etag := header(serveFile(fs, "GET", "hello.txt"), "ETag")
+
+	assert.Equal(t, 206, serveFile(fs, "GET", "hello.txt", "Range", "bytes=0-4", "If-Range", etag).Status)
+	assert.Equal(t, 206, serveFile(fs, "GET", "hello.txt", "Range", "bytes=0-4", "If-Range", "Fri, 01 Mar 2024 12:00:00 GMT").Status)
+	w := serveFile(fs, "GET", "hello.txt", "Range", "bytes=0-4", "If-Range", "\"stale\"")
+	assert.Equal(t, 200, w.Status)
+	assert.Equal(t, "Hello, World!", string(w.Body))
+}
+
+func TestFileServerMethods(t *testing.T) {
+	w := serveFile(FileServer(testFS()), "POST", "hello.txt")
+	assert.Equal(t, 405, w.Status)
+	assert.Equal(t, "GET, HEAD", header(w, "Allow"))
+}
+
+func atoi(t *testing.T, s string) int {
+	n := 0
+	for _, c := range s {
+		require.True(t, c >= '0' && c <= '9')
+		n = n * 10 + int(c - '0')
+	}
+	return n
+}
@@ -19,3 +19,26 @@ func (h HandlerFunc) ServeHttp(w response.ResponseWriter, r *request.Request) {
 	h(w, r)
 }
 
+
+// Middleware wraps a handler with behaviour that runs before and/or after it, such as logging or authentication. It gets the next handler in
+// line and returns the handler that should be called in its place.
+type Middleware func(Handler) Handler
+
+// Chain wraps h with the middleware. The first middleware is the outermost one, so Chain(h, a, b) runs a, then b, then h.
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// MaxBodyBytes overrides the body limit of the server for the requests going through the handler it wraps, e.g. to allow large uploads on a
+// single route. Zero or less removes the limit.
+func MaxBodyBytes(n int64) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w response.ResponseWriter, r *request.Request) {
+			r.SetBodyLimit(n)
+			next.ServeHttp(w, r)
+		})
+	}
+}
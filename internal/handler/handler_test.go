@@ -59,3 +59,37 @@ func TestMockHandler(t *testing.T) {
         t.Errorf("Expected body 'Hello, Neovim!', got %s", string(mockWriter.Body))
     }
 }
+
+func tagMiddleware(tag string) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w response.ResponseWriter, r *request.Request) {
+			w.Write([]byte(tag + ">"))
+			next.ServeHttp(w, r)
+			w.Write([]byte("<" + tag))
+		})
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	mockWriter := NewMockResponseWriter()
+	var final HandlerFunc = func(w response.ResponseWriter, r *request.Request) {
+		w.Write([]byte("handler"))
+	}
+
+	Chain(final, tagMiddleware("a"), tagMiddleware("b")).ServeHttp(mockWriter, &request.Request{})
+	if string(mockWriter.Body) != "a>b>handler<b<a" {
+		t.Errorf("Expected body 'a>b>handler<b<a', got %s", string(mockWriter.Body))
+	}
+}
+
+func TestChainWithoutMiddleware(t *testing.T) {
+	mockWriter := NewMockResponseWriter()
+	var final HandlerFunc = func(w response.ResponseWriter, r *request.Request) {
+		w.Write([]byte("handler"))
+	}
+
+	Chain(final).ServeHttp(mockWriter, &request.Request{})
+	if string(mockWriter.Body) != "handler" {
+		t.Errorf("Expected body 'handler', got %s", string(mockWriter.Body))
+	}
+}
@@ -2,44 +2,190 @@ package headers
 
 import (
 	"bytes"
+	"errors"
 	"strings"
 	"fmt"
+	"io"
+	"time"
 )
 
+// sidenote: a header field can show up more than once (Set-Cookie being the famous one, where joining the values with commas breaks them), and
+// the order of the fields is something proxies are expected to keep. So instead of a map of strings we keep a list of fields in the order they
+// were first seen, each with all of its values, plus a map from the lowercase name to the position of the field for lookups.
 type Headers struct {
-	headers map[string]string
+	fields []*field
+	index map[string]int
+	// last is the field the most recent value was added to, which is where an obsolete line fold continues
+	last *field
+}
+
+// ErrInvalidField is returned for a field whose name isn't a token or whose value contains control characters.
+var ErrInvalidField = errors.New("Invalid header field")
+
+// FoldPolicy decides what happens to obsolete line folding, a header value continued on the next line by starting that line with a space or tab.
+// RFC 9112 deprecates it, so it is rejected unless the server is told otherwise.
+type FoldPolicy int
+const (
+	FoldReject FoldPolicy = 0
+	// FoldNormalize joins the continuation lines to the value with a single space, as RFC 9112 section 5.2 allows.
+	FoldNormalize FoldPolicy = 1
+)
+
+type field struct {
+	// name is spelled the way it was first added or parsed
+	name string
+	values []string
 }
 
 func NewHeaders() *Headers {
 	return &Headers{
-		headers: map[string]string{},
+		index: map[string]int{},
 	}
 }
 
+func (h *Headers) lookup(name string) *field {
+	i, ok := h.index[strings.ToLower(name)]
+	if !ok {
+		return nil
+	}
+	return h.fields[i]
+}
+
+// Get returns the values of the field joined with commas, which is how a list-based field sent on several lines is meant to be read.
+// Fields that don't follow that rule, like Set-Cookie, should be read with Values.
 func (h *Headers) Get(name string) (string, bool) {
-	key := strings.ToLower(name)
-	i, ok := h.headers[key]
-	return i, ok
+	f := h.lookup(name)
+	if f == nil {
+		return "", false
+	}
+	return strings.Join(f.values, ", "), true
+}
+
+// Values returns every value of the field in the order they were added. The slice is a copy.
+func (h *Headers) Values(name string) []string {
+	f := h.lookup(name)
+	if f == nil {
+		return nil
+	}
+	return append([]string(nil), f.values...)
+}
+
+// Add appends a value to the field, keeping the values already there.
+func (h *Headers) Add(name string, value string) {
+	if f := h.lookup(name); f != nil {
+		f.values = append(f.values, value)
+		h.last = f
+		return
+	}
+	if h.index == nil {
+		h.index = map[string]int{}
+	}
+	h.index[strings.ToLower(name)] = len(h.fields)
+	h.last = &field{name: name, values: []string{value}}
+	h.fields = append(h.fields, h.last)
 }
 
+// Set replaces every value of the field with value. A field that already exists keeps its place in the order.
 func (h *Headers) Set(name string, value string) {
+	if f := h.lookup(name); f != nil {
+		f.values = []string{value}
+		h.last = f
+		return
+	}
+	h.Add(name, value)
+}
+
+// Del removes the field along with all of its values.
+func (h *Headers) Del(name string) {
 	key := strings.ToLower(name)
+	i, ok := h.index[key]
+	if !ok {
+		return
+	}
+	if h.last == h.fields[i] {
+		h.last = nil
+	}
+	h.fields = append(h.fields[:i], h.fields[i + 1:]...)
+	delete(h.index, key)
+	for ; i < len(h.fields); i++ {
+		h.index[strings.ToLower(h.fields[i].name)] = i
+	}
+}
 
-	exisiting, ok := h.Get(key)
-	
-	if ok {
-		h.headers[key] = exisiting + ", " + value
-	} else {
-		h.headers[key] = value
+// Len returns the number of distinct fields.
+func (h *Headers) Len() int {
+	return len(h.fields)
+}
+
+// Clone returns a deep copy, so changes to one side never show up on the other.
+func (h *Headers) Clone() *Headers {
+	clone := &Headers{
+		fields: make([]*field, len(h.fields)),
+		index: make(map[string]int, len(h.index)),
 	}
+	for i, f := range h.fields {
+		clone.fields[i] = &field{name: f.name, values: append([]string(nil), f.values...)}
+		clone.index[strings.ToLower(f.name)] = i
+	}
+	return clone
 }
 
+// ForEach calls fn once for every value of every field, in the order the fields were first added and with the names spelled as they were given.
 func (h *Headers) ForEach(fn func(key, value string)) {
-	for k,v := range h.headers {
-		fn(k, v)
+	for _, f := range h.fields {
+		for _, v := range f.values {
+			fn(f.name, v)
+		}
 	}
 }
 
+// Write writes the fields as header lines, in order and with canonical names. Fields with an invalid name or value are left out, since writing
+// them would let whoever controls the value (a CR LF in an echoed query parameter, say) add headers of their own or split the response. The first
+// such field is reported as an error wrapping ErrInvalidField once the valid ones have been written.
+func (h *Headers) Write(w io.Writer) error {
+	var invalid error
+	for _, f := range h.fields {
+		if !IsToken(f.name) {
+			if invalid == nil {
+				invalid = fmt.Errorf("%w: name %q", ErrInvalidField, f.name)
+			}
+			continue
+		}
+		name := CanonicalKey(f.name)
+		for _, v := range f.values {
+			if !ValidFieldValue(v) {
+				if invalid == nil {
+					invalid = fmt.Errorf("%w: value of %s", ErrInvalidField, name)
+				}
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "%s: %s\r\n", name, v); err != nil {
+				return err
+			}
+		}
+	}
+	return invalid
+}
+
+// CanonicalKey returns the usual spelling of a field name: the first letter and every letter after a hyphen in upper case, the rest in lower case,
+// so "content-type" becomes "Content-Type". Names that aren't valid tokens are returned unchanged.
+func CanonicalKey(name string) string {
+	if !IsToken(name) {
+		return name
+	}
+	canonical := []byte(name)
+	upper := true
+	for i, c := range canonical {
+		if upper && c >= 'a' && c <= 'z' {
+			canonical[i] = c - 'a' + 'A'
+		} else if !upper && c >= 'A' && c <= 'Z' {
+			canonical[i] = c - 'A' + 'a'
+		}
+		upper = c == '-'
+	}
+	return string(canonical)
+}
+
 func isTokenChar(char byte) bool {
 	if (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9') {
 		return true
@@ -69,7 +215,7 @@ func validateFieldName(name []byte) bool {
 func parseheaderline(fieldline []byte) (string, string, error) {
 	colonIndex := bytes.Index(fieldline, []byte(":"))
 	
-	if colonIndex == -1 {
+	if colonIndex <= 0 {
 		return "", "", fmt.Errorf("Error in trying to parse header line")
 	}
 	
@@ -79,11 +225,14 @@ func parseheaderline(fieldline []byte) (string, string, error) {
 	}
 
 	fieldname := fieldline[:colonIndex]
-	fieldvalue := bytes.TrimSpace(fieldline[colonIndex + 1:])
+	fieldvalue := bytes.Trim(fieldline[colonIndex + 1:], " \t")
 
 	if valid := validateFieldName(fieldname); !valid{
 		return "", "", fmt.Errorf("Error in trying to parse header line. Invalid tokens in field name")
 	}
+	if !ValidFieldValue(string(fieldvalue)) {
+		return "", "", fmt.Errorf("Error in trying to parse header line. Invalid characters in the value of %s", fieldname)
+	}
 
 	return string(fieldname), string(fieldvalue), nil
 }
@@ -100,7 +249,7 @@ func (h *Headers) validateMandatoryHeaders() error {
 	if !okHost {
 		return fmt.Errorf("No host detected")
 	}
-	if strings.Contains(exitisingHost, ",") {
+	if len(h.Values("Host")) > 1 || strings.Contains(exitisingHost, ",") {
 		return fmt.Errorf("More than one host has been detected")
 	}
 	
@@ -114,7 +263,13 @@ func (h *Headers) Validate() error {
 	return nil
 }
 
+// Parse reads header lines from data until the empty line ending the section, rejecting obsolete line folding.
 func (h *Headers) Parse(data []byte) (int, bool, error) {
+	return h.ParseWithPolicy(data, FoldReject)
+}
+
+// ParseWithPolicy is Parse with a choice of what to do with obsolete line folding.
+func (h *Headers) ParseWithPolicy(data []byte, policy FoldPolicy) (int, bool, error) {
 	bytesread := 0
 	done := false
 
@@ -131,14 +286,79 @@ func (h *Headers) Parse(data []byte) (int, bool, error) {
 			break
 		}
 
-		fieldname, fieldvalue, err := parseheaderline(data[bytesread : bytesread + sindex])
+		line := data[bytesread : bytesread + sindex]
+		if line[0] == ' ' || line[0] == '\t' {
+			if err := h.unfold(line, policy); err != nil {
+				return 0, done, err
+			}
+			bytesread += sindex + 2
+			continue
+		}
+
+		fieldname, fieldvalue, err := parseheaderline(line)
 	
 		if err != nil {
 			return 0, done, err
 		}
 		
-		h.Set(fieldname, fieldvalue)
+		h.Add(fieldname, fieldvalue)
 		bytesread += sindex + 2
 	}
 	return bytesread, done, nil
 }
+
+// unfold appends a continuation line to the value it continues.
+func (h *Headers) unfold(line []byte, policy FoldPolicy) error {
+	if policy != FoldNormalize {
+		return fmt.Errorf("Error in trying to parse header line. Obsolete line folding is not allowed")
+	}
+	if h.last == nil {
+		return fmt.Errorf("Error in trying to parse header line. Continuation line without a field to continue")
+	}
+	continuation := bytes.Trim(line, " \t")
+	if !ValidFieldValue(string(continuation)) {
+		return fmt.Errorf("Error in trying to parse header line. Invalid characters in the value of %s", h.last.name)
+	}
+	if len(continuation) == 0 {
+		return nil
+	}
+	i := len(h.last.values) - 1
+	if h.last.values[i] == "" {
+		h.last.values[i] = string(continuation)
+	} else {
+		h.last.values[i] += " " + string(continuation)
+	}
+	return nil
+}
+
+// ValidFieldValue reports whether v can be used as a field value: visible characters, spaces, tabs and obs-text (bytes 0x80 and up), but no NUL,
+// CR, LF or other control characters.
+func ValidFieldValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if (c < 0x20 && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// TimeFormat is the IMF-fixdate format of HTTP dates, as in Last-Modified: Sun, 06 Nov 1994 08:49:37 GMT. Times have to be in UTC.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// ParseTime parses an HTTP date. Besides IMF-fixdate it accepts the two obsolete formats RFC 9110 still asks recipients to understand.
+func ParseTime(value string) (time.Time, error) {
+	var err error
+	for _, layout := range []string{TimeFormat, time.RFC850, time.ANSIC} {
+		var t time.Time
+		if t, err = time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// IsToken reports whether s is a non-empty token as defined by RFC 9110, the grammar of field names, methods and most parameter names.
+func IsToken(s string) bool {
+	return s != "" && validateFieldName([]byte(s))
+}
@@ -1,6 +1,7 @@
 package headers
 
 import (
+	"strings"
 	"testing"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -79,3 +80,123 @@ func TestMutlipleHeaders(t *testing.T) {
 	require.Equal(t, "text/html, application/xhtml+xml, */*", headersaccept)
 }
 
+
+func TestIsToken(t *testing.T) {
+	assert.True(t, IsToken("Content-Type"))
+	assert.True(t, IsToken("x!#$%&'*+.^_`|~"))
+	assert.False(t, IsToken(""))
+	assert.False(t, IsToken("a b"))
+	assert.False(t, IsToken("a=b"))
+}
+
+func TestAddSetDel(t *testing.T) {
+	headers := NewHeaders()
+	headers.Add("Set-Cookie", "a=1; Path=/")
+	headers.Add("set-cookie", "b=2, c")
+	headers.Add("X-Other", "x")
+
+	assert.Equal(t, []string{"a=1; Path=/", "b=2, c"}, headers.Values("SET-COOKIE"))
+	headers.Set("Set-Cookie", "d=4")
+	assert.Equal(t, []string{"d=4"}, headers.Values("Set-Cookie"))
+	assert.Equal(t, 2, headers.Len())
+
+	headers.Del("set-cookie")
+	_, ok := headers.Get("Set-Cookie")
+	assert.False(t, ok)
+	assert.Nil(t, headers.Values("Set-Cookie"))
+	value, ok := headers.Get("x-other")
+	assert.True(t, ok)
+	assert.Equal(t, "x", value)
+}
+
+func TestForEachKeepsOrderAndCase(t *testing.T) {
+	headers := NewHeaders()
+	_, _, err := headers.Parse([]byte("Host: localhost\r\nx-lower: 1\r\nAccept: a\r\nX-LOWER: 2\r\n\r\n"))
+	require.NoError(t, err)
+
+	var lines []string
+	headers.ForEach(func(key, value string) {
+		lines = append(lines, key + "=" + value)
+	})
+	assert.Equal(t, []string{"Host=localhost", "x-lower=1", "x-lower=2", "Accept=a"}, lines)
+}
+
+func TestClone(t *testing.T) {
+	headers := NewHeaders()
+	headers.Add("Vary", "Accept")
+	clone := headers.Clone()
+	clone.Add("Vary", "Accept-Encoding")
+	clone.Set("X-New", "1")
+
+	assert.Equal(t, []string{"Accept"}, headers.Values("Vary"))
+	assert.Equal(t, []string{"Accept", "Accept-Encoding"}, clone.Values("Vary"))
+	_, ok := headers.Get("X-New")
+	assert.False(t, ok)
+}
+
+func TestWriteUsesCanonicalNames(t *testing.T) {
+	headers := NewHeaders()
+	headers.Set("content-type", "text/plain")
+	headers.Add("SET-COOKIE", "a=1")
+	headers.Add("set-cookie", "b=2")
+	headers.Set("x-request-id", "7")
+
+	var out strings.Builder
+	require.NoError(t, headers.Write(&out))
+	assert.Equal(t, "Content-Type: text/plain\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\nX-Request-Id: 7\r\n", out.String())
+	assert.Equal(t, "Www-Authenticate", CanonicalKey("WWW-AUTHENTICATE"))
+	assert.Equal(t, "bad key", CanonicalKey("bad key"))
+}
+
+func TestZeroValueHeaders(t *testing.T) {
+	var headers Headers
+	headers.Set("Host", "localhost")
+	value, ok := headers.Get("host")
+	assert.True(t, ok)
+	assert.Equal(t, "localhost", value)
+}
+
+func TestEmptyFieldName(t *testing.T) {
+	_, _, err := NewHeaders().Parse([]byte(": value\r\n\r\n"))
+	assert.Error(t, err)
+}
+
+func TestInvalidFieldValues(t *testing.T) {
+	values := []string{"a\x00b", "a\rb", "a\nb", "a\x7fb", "a\x1bb"}
+	for _, value := range values {
+		_, _, err := NewHeaders().Parse([]byte("X-Bad: " + value + "\r\n\r\n"))
+		assert.Error(t, err, "value %q", value)
+	}
+	_, _, err := NewHeaders().Parse([]byte("X-Ok: tab\tand obs-text \xe9\r\n\r\n"))
+	assert.NoError(t, err)
+}
+
+func TestObsFold(t *testing.T) {
+	data := []byte("Host: localhost\r\nX-Folded: first\r\n  second\r\n\tthird\r\nAccept: */*\r\n\r\n")
+
+	_, _, err := NewHeaders().Parse(data)
+	assert.Error(t, err)
+
+	headers := NewHeaders()
+	n, done, err := headers.ParseWithPolicy(data, FoldNormalize)
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, len(data), n)
+	folded, _ := headers.Get("X-Folded")
+	assert.Equal(t, "first second third", folded)
+
+	_, _, err = NewHeaders().ParseWithPolicy([]byte(" leading: fold\r\n\r\n"), FoldNormalize)
+	assert.Error(t, err)
+}
+
+func TestWriteDropsInvalidFields(t *testing.T) {
+	headers := NewHeaders()
+	headers.Set("Location", "/next\r\nSet-Cookie: admin=1")
+	headers.Set("Bad Name", "x")
+	headers.Set("X-Ok", "fine")
+
+	var out strings.Builder
+	err := headers.Write(&out)
+	assert.ErrorIs(t, err, ErrInvalidField)
+	assert.Equal(t, "X-Ok: fine\r\n", out.String())
+}
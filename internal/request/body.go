@@ -0,0 +1,233 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrBodyReadAfterClose is returned when a handler reads from BodyReader after closing it.
+var ErrBodyReadAfterClose = errors.New("Read on closed request body")
+
+// sidenote: the body reader is what keeps a 2 GB upload from turning into 2 GB of memory. Instead of the parser collecting the whole body before
+// the handler runs, the body states of the parser run each time the handler asks for more, and only ever hold one buffer worth of the body.
+type bodyReader struct {
+	reader *RequestReader
+	request *Request
+	closed bool
+	// err is sticky: once the body has failed (or ended) every later read returns the same error
+	err error
+	// limit is the most body bytes the handler may read, zero meaning no limit. onLimit is called the moment it is exceeded.
+	limit int64
+	onLimit func()
+	produced int64
+	// onDone is called once, when the last byte of the body has been read
+	onDone func()
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyReadAfterClose
+	}
+	return b.read(p)
+}
+
+// Close stops the handler from reading any further. Whatever is left of the body is discarded by the server before it reads the next request.
+func (b *bodyReader) Close() error {
+	b.closed = true
+	return nil
+}
+
+func (b *bodyReader) read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if b.limit <= 0 {
+		return b.readFramed(p)
+	}
+
+	// a Content-Length over the limit is refused before a single byte of it is read
+	r := b.request
+	if r.state == StateBodyFixed && b.produced + int64(r.bodyLength) > b.limit {
+		return 0, b.exceeded()
+	}
+	allowed := b.limit - b.produced
+	if allowed == 0 {
+		// the limit is used up, so the body had better be over. A single byte more means it isn't.
+		var probe [1]byte
+		n, err := b.readFramed(probe[:])
+		if n > 0 {
+			return 0, b.exceeded()
+		}
+		return 0, err
+	}
+	if int64(len(p)) > allowed {
+		p = p[:allowed]
+	}
+	n, err := b.readFramed(p)
+	b.produced += int64(n)
+	return n, err
+}
+
+func (b *bodyReader) exceeded() error {
+	b.err = &MaxBytesError{Limit: b.limit}
+	if b.onLimit != nil {
+		b.onLimit()
+	}
+	return b.err
+}
+
+// readFramed reads body bytes following the framing of the request, running the body states of the parser as needed.
+func (b *bodyReader) readFramed(p []byte) (int, error) {
+	rr := b.reader
+	r := b.request
+	for {
+		if r.state == StateDone {
+			b.err = io.EOF
+			b.done()
+			return 0, io.EOF
+		}
+
+		// a large read of a fixed length body with nothing buffered can go straight into the caller's slice, saving a copy through our buffer
+		if r.state == StateBodyFixed && rr.bSize == 0 && len(p) >= len(rr.buffer) {
+			limit := len(p)
+			if limit > r.bodyLength {
+				limit = r.bodyLength
+			}
+			n, err := rr.reader.Read(p[:limit])
+			r.bodyLength -= n
+			if r.bodyLength == 0 {
+				r.state = StateDone
+				b.done()
+			}
+			if n > 0 {
+				return n, nil
+			}
+			if err != nil {
+				return 0, b.fail(err)
+			}
+			continue
+		}
+
+		consumed, n, err := r.parseBody(rr.buffer[:rr.bSize], p)
+		rr.consume(consumed)
+		if err != nil {
+			b.err = err
+			return n, err
+		}
+		// a handler that reads exactly the body it expects never comes back for the EOF, so the body is done as soon as its last byte is read
+		if r.state == StateDone {
+			b.done()
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if r.state == StateDone {
+			continue
+		}
+
+		if consumed == 0 && rr.bSize == len(rr.buffer) {
+			b.err = fmt.Errorf("%w: Chunk line too long", ErrMalformedBody)
+			return 0, b.err
+		}
+		if err := rr.fill(); err != nil {
+			return 0, b.fail(err)
+		}
+	}
+}
+
+// done calls onDone, once.
+func (b *bodyReader) done() {
+	if fn := b.onDone; fn != nil {
+		b.onDone = nil
+		fn()
+	}
+}
+
+// fail records a read error from the connection. Running out of bytes before the body is complete means the client went away mid request.
+func (b *bodyReader) fail(err error) error {
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	b.err = err
+	return err
+}
+
+// SetBodyLimit caps the body at n bytes, replacing any earlier limit. n <= 0 removes the limit. Reading past the limit fails with a *MaxBytesError
+// and the rest of the body is left unread. It only applies to bodies streamed off a connection.
+func (r *Request) SetBodyLimit(n int64) {
+	if r.body != nil {
+		r.body.limit = n
+	}
+}
+
+// BodyLimit returns the limit set by SetBodyLimit, zero meaning no limit.
+func (r *Request) BodyLimit() int64 {
+	if r.body == nil {
+		return 0
+	}
+	return r.body.limit
+}
+
+// OnBodyLimit registers a function to call when the body goes over its limit. The server uses it to answer with a 413.
+func (r *Request) OnBodyLimit(fn func()) {
+	if r.body != nil {
+		r.body.onLimit = fn
+	}
+}
+
+// OnBodyDone registers a function to call once the body has been read to the end. It is called right away if there is no body left to read.
+// The server uses it to start watching the connection for the client going away.
+func (r *Request) OnBodyDone(fn func()) {
+	if r.body != nil {
+		r.body.onDone = nil
+	}
+	if r.state != StateDone {
+		if r.body != nil {
+			r.body.onDone = fn
+		}
+		return
+	}
+	if fn != nil {
+		fn()
+	}
+}
+
+// ReadBody reads whatever is left of the body into Body and returns it. It is the convenience for handlers that want the whole body in memory,
+// with the obvious cost for large uploads.
+func (r *Request) ReadBody() ([]byte, error) {
+	if r.BodyReader == nil {
+		return r.Body, nil
+	}
+	data, err := io.ReadAll(r.BodyReader)
+	r.Body = append(r.Body, data...)
+	return r.Body, err
+}
+
+// DiscardBody reads and throws away up to limit bytes of whatever the handler left unread, even if the handler closed BodyReader. It reports
+// whether the body has been fully consumed, which is what decides if the connection can carry another request. The limit set by SetBodyLimit
+// doesn't apply here, but a body that already went over it is never discarded.
+func (r *Request) DiscardBody(limit int64) bool {
+	if r.body == nil {
+		return true
+	}
+	if r.body.err != nil {
+		return errors.Is(r.body.err, io.EOF)
+	}
+	buffer := make([]byte, 4096)
+	var discarded int64
+	for discarded <= limit {
+		n, err := r.body.readFramed(buffer)
+		discarded += int64(n)
+		if errors.Is(err, io.EOF) {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package request
+
+import (
+	"fmt"
+	"strconv"
+	"github.com/juancruzfl/httpserver/internal/headers"
+)
+
+// maxChunkSizeDigits keeps the size of a chunk within an int64. Leading zeros are allowed by the grammar but nobody needs sixteen of them.
+const maxChunkSizeDigits = 16
+
+// parseChunkLine parses the line that starts a chunk, chunk-size [ chunk-ext ], as defined in RFC 9112 section 7.1. Extensions are checked
+// against the grammar and then ignored, which is what the spec asks of a recipient that doesn't understand them.
+//
+// sidenote: strconv.ParseInt alone is too forgiving here ("+1a" and "-0" both parse), and a lenient size is exactly what lets a proxy and a server
+// disagree on where a chunk ends. So every character of the size has to be a hex digit.
+func parseChunkLine(line []byte) (int64, error) {
+	i := 0
+	for i < len(line) && isHexDigit(line[i]) {
+		i++
+	}
+	if i == 0 || i > maxChunkSizeDigits {
+		return 0, fmt.Errorf("%w: Invalid chunk size %q", ErrMalformedBody, line)
+	}
+	size, err := strconv.ParseInt(string(line[:i]), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: Invalid chunk size %q", ErrMalformedBody, line)
+	}
+	if err := validateChunkExtensions(line[i:]); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// validateChunkExtensions checks what follows the chunk size: *( BWS ";" BWS name [ BWS "=" BWS ( token / quoted-string ) ] ).
+func validateChunkExtensions(ext []byte) error {
+	i := skipWhitespace(ext, 0)
+	for i < len(ext) {
+		if ext[i] != ';' {
+			return fmt.Errorf("%w: Invalid chunk extension %q", ErrMalformedBody, ext)
+		}
+		i = skipWhitespace(ext, i + 1)
+		start := i
+		i = skipToken(ext, i)
+		if i == start {
+			return fmt.Errorf("%w: Chunk extension without a name %q", ErrMalformedBody, ext)
+		}
+		i = skipWhitespace(ext, i)
+		if i < len(ext) && ext[i] == '=' {
+			i = skipWhitespace(ext, i + 1)
+			end, ok := skipValue(ext, i)
+			if !ok {
+				return fmt.Errorf("%w: Invalid chunk extension value %q", ErrMalformedBody, ext)
+			}
+			i = skipWhitespace(ext, end)
+		}
+	}
+	return nil
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func skipWhitespace(s []byte, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+func skipToken(s []byte, i int) int {
+	for i < len(s) && headers.IsToken(string(s[i])) {
+		i++
+	}
+	return i
+}
+
+// skipValue skips a token or a quoted-string starting at i, reporting false if there is neither or the quoted-string never ends.
+func skipValue(s []byte, i int) (int, bool) {
+	if i < len(s) && s[i] == '"' {
+		for i++; i < len(s); i++ {
+			switch s[i] {
+			case '"':
+				return i + 1, true
+			case '\\':
+				i++
+			}
+		}
+		return i, false
+	}
+	end := skipToken(s, i)
+	return end, end > i
+}
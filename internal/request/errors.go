@@ -0,0 +1,38 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+)
+
+// sidenote: these are the reasons a request can fail to parse. Every error returned by the parser wraps exactly one of them, so callers can use
+// errors.Is to decide how to answer the client (the server turns them into 4xx/5xx responses) without having to look at the error message.
+var (
+	// ErrMalformedRequestLine means the request line is not of the form "METHOD /target HTTP/x.y".
+	ErrMalformedRequestLine = errors.New("Malformed request line")
+	// ErrMalformedHeader means a header field line could not be parsed, or the header section describes the body in a way we can't trust.
+	ErrMalformedHeader = errors.New("Malformed header field")
+	// ErrMalformedBody means the body does not follow the framing announced by the headers, e.g. an invalid chunk size.
+	ErrMalformedBody = errors.New("Malformed request body")
+	// ErrHeaderTooLarge means the request line and header section did not fit within the allowed size.
+	ErrHeaderTooLarge = errors.New("Request header section too large")
+	// ErrBodyTooLarge is wrapped by the MaxBytesError a handler gets when it reads a body past its limit. The parser itself never returns it.
+	ErrBodyTooLarge = errors.New("Request body too large")
+	// ErrUnsupportedVersion means the request line is well formed but asks for an http version other than 1.0 or 1.1.
+	ErrUnsupportedVersion = errors.New("Unsupported http version")
+	// ErrUnsupportedTransferEncoding means the request uses a transfer coding other than chunked.
+	ErrUnsupportedTransferEncoding = errors.New("Unsupported transfer encoding")
+)
+
+// MaxBytesError is returned when a body is read past the limit set on it. It wraps ErrBodyTooLarge.
+type MaxBytesError struct {
+	Limit int64
+}
+
+func (e *MaxBytesError) Error() string {
+	return fmt.Sprintf("%v: limit is %d bytes", ErrBodyTooLarge, e.Limit)
+}
+
+func (e *MaxBytesError) Unwrap() error {
+	return ErrBodyTooLarge
+}
@@ -0,0 +1,161 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+)
+
+var (
+	ErrNotMultipart = errors.New("Request Content-Type isn't multipart/form-data")
+	ErrMissingFile = errors.New("No such file in the form")
+	// ErrFormTooLarge is returned by ParseForm when a urlencoded body is over maxFormBytes.
+	ErrFormTooLarge = errors.New("Form body too large")
+)
+
+// maxFormBytes caps a urlencoded body read by ParseForm, since all of it ends up in memory. Multipart bodies are not capped here, their files
+// go to disk past the memory threshold, and the body limit of the server applies to both.
+const maxFormBytes = 10 << 20
+
+// defaultMaxMemory is how much of a multipart form FormValue and FormFile keep in memory before file parts are written to temp files.
+const defaultMaxMemory = 32 << 20
+
+// ParseForm fills in Form and PostForm. PostForm holds the fields of an application/x-www-form-urlencoded body sent with POST, PUT or PATCH,
+// and Form holds those followed by the query parameters of the request target. It reads the body, so it should not be mixed with reading
+// BodyReader. Calling it more than once is harmless. Malformed pairs are skipped and the first error is returned, like ParseQuery.
+func (r *Request) ParseForm() error {
+	if r.PostForm != nil {
+		return nil
+	}
+	var err error
+	r.PostForm = Values{}
+	if r.hasFormBody() {
+		mediaType, _, _ := mime.ParseMediaType(r.contentType())
+		if mediaType == "application/x-www-form-urlencoded" {
+			err = r.parsePostForm()
+		}
+	}
+
+	r.Form = Values{}
+	for key, values := range r.PostForm {
+		r.Form[key] = append(r.Form[key], values...)
+	}
+	query, queryErr := ParseQuery(r.URL.RawQuery)
+	for key, values := range query {
+		r.Form[key] = append(r.Form[key], values...)
+	}
+	if err == nil {
+		err = queryErr
+	}
+	return err
+}
+
+func (r *Request) parsePostForm() error {
+	if r.BodyReader == nil {
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r.BodyReader, maxFormBytes + 1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxFormBytes {
+		return ErrFormTooLarge
+	}
+	values, err := ParseQuery(string(data))
+	r.PostForm = values
+	return err
+}
+
+// ParseMultipartForm parses a multipart/form-data body into MultipartForm, keeping up to maxMemory bytes of it in memory. File parts that don't
+// fit are spilled to temp files, which the server removes once the handler has returned. The text fields are also added to Form and PostForm.
+func (r *Request) ParseMultipartForm(maxMemory int64) error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	mediaType, params, err := mime.ParseMediaType(r.contentType())
+	if err != nil || mediaType != "multipart/form-data" {
+		return ErrNotMultipart
+	}
+	boundary, ok := params["boundary"]
+	if !ok || boundary == "" || r.BodyReader == nil {
+		return ErrNotMultipart
+	}
+
+	// sidenote: the multipart reader pulls the body off BodyReader as it goes, so a large upload streams through a small buffer into its temp file
+	// instead of sitting in memory first
+	form, err := multipart.NewReader(r.BodyReader, boundary).ReadForm(maxMemory)
+	if err != nil {
+		return fmt.Errorf("Error in trying to parse multipart form: %w", err)
+	}
+	r.MultipartForm = form
+	for key, values := range form.Value {
+		r.PostForm[key] = append(r.PostForm[key], values...)
+		r.Form[key] = append(r.Form[key], values...)
+	}
+	return nil
+}
+
+// FormValue returns the first value of the form field or query parameter, parsing the form if needed. Parse errors are ignored; call ParseForm
+// or ParseMultipartForm to see them.
+func (r *Request) FormValue(key string) string {
+	r.parseAnyForm()
+	return r.Form.Get(key)
+}
+
+// PostFormValue is FormValue without the query parameters.
+func (r *Request) PostFormValue(key string) string {
+	r.parseAnyForm()
+	return r.PostForm.Get(key)
+}
+
+// FormFile returns the first file uploaded under the form field key, parsing the multipart form if needed.
+func (r *Request) FormFile(key string) (multipart.File, *multipart.FileHeader, error) {
+	if r.MultipartForm == nil {
+		if err := r.ParseMultipartForm(defaultMaxMemory); err != nil {
+			return nil, nil, err
+		}
+	}
+	files := r.MultipartForm.File[key]
+	if len(files) == 0 {
+		return nil, nil, ErrMissingFile
+	}
+	file, err := files[0].Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, files[0], nil
+}
+
+// RemoveMultipartFiles deletes the temp files of a parsed multipart form. The server calls it once the handler has returned.
+func (r *Request) RemoveMultipartFiles() error {
+	if r.MultipartForm == nil {
+		return nil
+	}
+	return r.MultipartForm.RemoveAll()
+}
+
+func (r *Request) parseAnyForm() {
+	if r.MultipartForm == nil {
+		if err := r.ParseMultipartForm(defaultMaxMemory); errors.Is(err, ErrNotMultipart) {
+			r.ParseForm()
+		}
+	}
+}
+
+func (r *Request) hasFormBody() bool {
+	switch r.RequestLine.Method {
+	case "POST", "PUT", "PATCH":
+		return true
+	}
+	return false
+}
+
+func (r *Request) contentType() string {
+	contentType, _ := r.Headers.Get("Content-Type")
+	return contentType
+}
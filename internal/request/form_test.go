@@ -0,0 +1,90 @@
+package request
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func formRequest(t *testing.T, target string, contentType string, body string) *Request {
+	data := "POST " + target + " HTTP/1.1\r\nHost: localhost\r\nContent-Type: " + contentType + "\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	r, err := NewRequestReader(strings.NewReader(data)).ReadRequest()
+	require.NoError(t, err)
+	return r
+}
+
+func TestParseForm(t *testing.T) {
+	r := formRequest(t, "/submit?name=query&page=2", "application/x-www-form-urlencoded; charset=utf-8", "name=form+value&tags=a&tags=b%21")
+	require.NoError(t, r.ParseForm())
+
+	assert.Equal(t, []string{"form value", "query"}, r.Form["name"])
+	assert.Equal(t, "form value", r.FormValue("name"))
+	assert.Equal(t, "2", r.FormValue("page"))
+	assert.Equal(t, "", r.PostFormValue("page"))
+	assert.Equal(t, []string{"a", "b!"}, r.PostForm["tags"])
+}
+
+func TestParseFormIgnoresOtherBodies(t *testing.T) {
+	r := formRequest(t, "/submit?a=1", "application/json", `{"a":2}`)
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, "1", r.FormValue("a"))
+	assert.Empty(t, r.PostForm)
+
+	body, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, `{"a":2}`, string(body), "a body that isn't a form should be left for the handler")
+}
+
+const multipartBody = "--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"title\"\r\n\r\n" +
+	"holiday\r\n" +
+	"--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"photo\"; filename=\"beach.txt\"\r\n" +
+	"Content-Type: text/plain\r\n\r\n" +
+	"sand and sea, and more sand\r\n" +
+	"--XyZ--\r\n"
+
+func TestMultipartForm(t *testing.T) {
+	r := formRequest(t, "/upload?album=summer", "multipart/form-data; boundary=XyZ", multipartBody)
+
+	assert.Equal(t, "holiday", r.FormValue("title"))
+	assert.Equal(t, "summer", r.FormValue("album"))
+	assert.Equal(t, "holiday", r.PostFormValue("title"))
+
+	file, header, err := r.FormFile("photo")
+	require.NoError(t, err)
+	defer file.Close()
+	assert.Equal(t, "beach.txt", header.Filename)
+	data, err := io.ReadAll(file)
+	require.NoError(t, err)
+	assert.Equal(t, "sand and sea, and more sand", string(data))
+
+	_, _, err = r.FormFile("missing")
+	assert.ErrorIs(t, err, ErrMissingFile)
+}
+
+func TestMultipartFileSpillsToDisk(t *testing.T) {
+	r := formRequest(t, "/upload", "multipart/form-data; boundary=XyZ", multipartBody)
+	require.NoError(t, r.ParseMultipartForm(8))
+
+	file, _, err := r.FormFile("photo")
+	require.NoError(t, err)
+	osFile, ok := file.(*os.File)
+	require.True(t, ok, "a file over the memory threshold should live in a temp file")
+	name := osFile.Name()
+	file.Close()
+
+	require.NoError(t, r.RemoveMultipartFiles())
+	_, err = os.Stat(name)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNotMultipart(t *testing.T) {
+	r := formRequest(t, "/upload", "application/x-www-form-urlencoded", "a=1")
+	assert.ErrorIs(t, r.ParseMultipartForm(1024), ErrNotMultipart)
+	assert.Equal(t, "1", r.FormValue("a"))
+}
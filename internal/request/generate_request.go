@@ -1,6 +1,8 @@
 package request
 
 import (
+	"bytes"
+	"io"
 	"github.com/juancruzfl/httpserver/internal/headers"
 	"math/rand/v2"
 )
@@ -30,9 +32,12 @@ func NewRandomRequestLine() *RequestLine{
 func NewMockRequest(requestLine *RequestLine,headers headers.Headers, body []byte, bodyLength int) *Request {
 	request := newRequest()
 	request.RequestLine = *requestLine
+	request.URL, _ = parseRequestTarget(requestLine.RequestTarget)
 	request.Headers = headers
 	request.Body = body
+	request.BodyReader = io.NopCloser(bytes.NewReader(body))
 	request.bodyLength = bodyLength 
+	request.state = StateDone
 	return request
 }
 
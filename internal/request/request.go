@@ -1,13 +1,17 @@
 package request
 
 import (
+	"context"
+	"crypto/tls"
 	"io"
+	"mime/multipart"
 	"strings"
 	"strconv"
 	"errors"
 	"fmt"
 	"unicode"
 	"bytes"
+	"github.com/juancruzfl/httpserver/internal/cookie"
 	"github.com/juancruzfl/httpserver/internal/headers"
 )
 
@@ -19,18 +23,45 @@ type RequestLine struct {
 
 type Request struct {
 	RequestLine RequestLine	
+	// URL is the parsed form of RequestLine.RequestTarget
+	URL URL
 	Headers headers.Headers
+	// Trailer holds the trailer fields sent after a chunked body. It is only filled in once the body has been read to the end.
+	Trailer headers.Headers
+	// Body is only filled in once the body has been read as a whole, by ReadBody or RequestFromReader. Handlers that can work with a stream
+	// should read from BodyReader instead.
 	Body []byte
+	// BodyReader streams the body straight off the connection as the handler reads it.
+	BodyReader io.ReadCloser
+	// Form holds the form fields followed by the query parameters, and PostForm only the form fields. Both are nil until ParseForm is called.
+	Form Values
+	PostForm Values
+	// TLS describes the TLS connection the request came in on, or is nil for plain HTTP.
+	TLS *tls.ConnectionState
+	// MultipartForm is the parsed multipart/form-data body, nil until ParseMultipartForm is called.
+	MultipartForm *multipart.Form
+	body *bodyReader
+	// bodyLength is what is left to read of a fixed length body, or of the current chunk of a chunked one
 	bodyLength int
 	state parserState
+	pathValues map[string]string
+	foldPolicy headers.FoldPolicy
+	ctx context.Context
+	// the trailer section gets the same limits as the header section, and trailerBytes counts it against them
+	maxTrailerBytes int
+	maxTrailerCount int
+	trailerBytes int
 }
 
 func newRequest() *Request {
 	return &Request{
 		Headers: *headers.NewHeaders(),
+		Trailer: *headers.NewHeaders(),
 		state: StateInit,
 		Body: nil,
 		bodyLength: 0,
+		maxTrailerBytes: DefaultMaxHeaderBytes,
+		maxTrailerCount: DefaultMaxHeaderCount,
 	}
 }
 type parserState int 
@@ -41,6 +72,8 @@ const (
 	StateBodyFixed parserState = 3
 	StateBodyChunkedRead parserState = 4
 	StateBodyChunkedWrite parserState = 5
+	StateBodyChunkedEnd parserState = 6
+	StateTrailers parserState = 7
 )
 
 func StringIsUpper(s string) bool {
@@ -52,6 +85,18 @@ func StringIsUpper(s string) bool {
 	return true
 }
 
+// parseHttpVersion checks that the version follows the "HTTP/" DIGIT "." DIGIT grammar and returns the "x.y" part of it.
+func parseHttpVersion(version string) (string, bool) {
+	number, found := strings.CutPrefix(version, "HTTP/")
+	if !found || len(number) != 3 || number[1] != '.' {
+		return "", false
+	}
+	if number[0] < '0' || number[0] > '9' || number[2] < '0' || number[2] > '9' {
+		return "", false
+	}
+	return number, true
+}
+
 func parseRequestLine(b []byte) (*RequestLine, int, error) {
 	spIndex := bytes.Index(b, []byte("\r\n"))
 
@@ -64,29 +109,28 @@ func parseRequestLine(b []byte) (*RequestLine, int, error) {
 	requestLineFields := strings.Fields(startLine)
 
 	if len(requestLineFields) != 3 {
-		return nil, 0, fmt.Errorf("Request line is missing information")
+		return nil, 0, fmt.Errorf("%w: Request line is missing information", ErrMalformedRequestLine)
 	}
 
 	method := requestLineFields[0]
 
 	if StringIsUpper(method) == false {
-		return nil, 0, fmt.Errorf("Error in the request line parsing: Invalid Method format")
+		return nil, 0, fmt.Errorf("%w: Invalid Method format", ErrMalformedRequestLine)
 	}
 
 	requestTarget := requestLineFields[1]
 
 	if strings.HasPrefix(requestTarget, "/") == false {
-		return nil, 0, fmt.Errorf("Error in the request line parsing: Invalid resource format")
+		return nil, 0, fmt.Errorf("%w: Invalid resource format", ErrMalformedRequestLine)
 	}
 
-	versionSplit1 := strings.Split(requestLineFields[2], "/")
-
-	versionSplit2 := strings.Split(versionSplit1[1], "\r\n")
-
-	httpVersion := versionSplit2[0]
+	httpVersion, ok := parseHttpVersion(requestLineFields[2])
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: Invalid http version format", ErrMalformedRequestLine)
+	}
 
-	if httpVersion != "1.1" && httpVersion != "1.0" && httpVersion != "2.0" && httpVersion != "3.0" {
-		return nil, 0, fmt.Errorf("Error in the request line parsing: Unsupported http version")
+	if httpVersion != "1.1" && httpVersion != "1.0" {
+		return nil, 0, fmt.Errorf("%w: HTTP/%s", ErrUnsupportedVersion, httpVersion)
 	}
 
 	var returnedRequestLine RequestLine 
@@ -109,6 +153,12 @@ func (r *Request) parse(data []byte) (int, error) {
 		
 		switch r.state {
 			case StateInit:
+				// sidenote: some clients send a stray CRLF after the body of a POST, which then shows up in front of the next request line. RFC 9112
+				// section 2.2 asks servers to ignore empty lines there, and they still count towards the header size limit.
+				if bytes.HasPrefix(data[bytesRead:], []byte("\r\n")) {
+					bytesRead += 2
+					continue
+				}
 				requestLine, n, err := parseRequestLine(data[bytesRead:])
 				if err != nil {
 					return 0, err
@@ -118,124 +168,445 @@ func (r *Request) parse(data []byte) (int, error) {
 					break outer
 				}
 
+				url, err := parseRequestTarget(requestLine.RequestTarget)
+				if err != nil {
+					return 0, fmt.Errorf("%w: %w", ErrMalformedRequestLine, err)
+				}
+
 				r.RequestLine = *requestLine
+				r.URL = url
 				bytesRead += n + 2
 				r.state = StateHeaders
 			
 			case StateHeaders:
-				headerBytesRead, done, err := r.Headers.Parse(data[bytesRead:])
+				headerBytesRead, done, err := r.Headers.ParseWithPolicy(data[bytesRead:], r.foldPolicy)
 				if err != nil {
-					return 0, err
+					return 0, fmt.Errorf("%w: %w", ErrMalformedHeader, err)
 				}
 
 				bytesRead += headerBytesRead
-				
-				if done {					
-					if contentLength, clok := r.Headers.Get("Content-Length"); clok {
-						bodyLength, bodyErr := strconv.Atoi(contentLength)
-						if bodyErr != nil {
-							return 0, bodyErr
-						}
-						if bodyLength == 0 {
-							r.state = StateDone
-							break outer
-						}
-						r.bodyLength = bodyLength
-						r.state = StateBodyFixed
-					} else if _, teok := r.Headers.Get("Transfer-Encoding"); teok {
-						r.state = StateBodyChunkedRead
-					} else {
+
+				if !done {
+					break outer
+				}
+
+				contentLength, clok := r.Headers.Get("Content-Length")
+				transferEncoding, teok := r.Headers.Get("Transfer-Encoding")
+
+				// sidenote: a request carrying both framing headers is the classic request smuggling vector, since a proxy in front of us might
+				// pick the other one. We refuse it instead of guessing.
+				if clok && teok {
+					return 0, fmt.Errorf("%w: Transfer-Encoding and Content-Length detected", ErrMalformedHeader)
+				}
+
+				if clok {
+					bodyLength, bodyErr := parseContentLength(contentLength)
+					if bodyErr != nil {
+						return 0, bodyErr
+					}
+					if bodyLength == 0 {
 						r.state = StateDone
+						break outer
 					}
+					r.bodyLength = bodyLength
+					r.state = StateBodyFixed
+					break outer
+				} else if teok {
+					if !strings.EqualFold(strings.TrimSpace(transferEncoding), "chunked") {
+						return 0, fmt.Errorf("%w: %s", ErrUnsupportedTransferEncoding, transferEncoding)
+					}
+					r.state = StateBodyChunkedRead
+					break outer
+				} else {
+					r.state = StateDone
 				}
+			default:
+				// the body is not parsed here, it is streamed to the handler by parseBody
+				break outer
+		}
+	}
+	return bytesRead, nil
+
+}
+
+// parseBody runs the body states of the parser. It consumes framing and body bytes from data and copies the body bytes into p, returning how
+// much of data was consumed and how many body bytes ended up in p. It stops once p is full, the body is done or data runs out.
+func (r *Request) parseBody(data []byte, p []byte) (int, int, error) {
+	bytesRead := 0
+	produced := 0
+	outer :
+	for produced < len(p) {
+		switch r.state {
 			case StateBodyFixed:
-				remaining := r.bodyLength - len(r.Body)
-				available := len(data) - bytesRead		
-				if available > remaining {
-					return bytesRead, fmt.Errorf("Too many characters sent by request")
+				n := copy(p[produced:], data[bytesRead:])
+				// anything past the declared length belongs to the next request on the connection
+				if n > r.bodyLength {
+					n = r.bodyLength
 				}
-				
-				r.Body = append(r.Body, data[bytesRead: bytesRead + available]...)
-				bytesRead += available
-				
-				if len(r.Body) == r.bodyLength {
+				if n == 0 {
+					break outer
+				}
+				bytesRead += n
+				produced += n
+				r.bodyLength -= n
+
+				if r.bodyLength == 0 {
 					r.state = StateDone
-				}	
+				}
 			case StateBodyChunkedRead:
 				sIndex := bytes.Index(data[bytesRead:], []byte("\r\n"))
 				if sIndex == -1 {
-					return bytesRead, nil
+					break outer
 				}
-				hexaSize := string(data[bytesRead: sIndex])
-				decimalSize, err := strconv.ParseInt(hexaSize, 16, 64)
-				bodySize := int(decimalSize)
-
+				decimalSize, err := parseChunkLine(data[bytesRead: bytesRead + sIndex])
 				if err != nil {
-					return bytesRead, err
+					return bytesRead, produced, err
 				}
-				sizeLength := sIndex - bytesRead
-				bytesRead += sizeLength + 2
-				
-				if bodySize == 0{
-					bytesRead += 2
-					r.state = StateDone
-					break outer
+				bytesRead += sIndex + 2
+
+				if decimalSize == 0 {
+					r.state = StateTrailers
+					continue
 				}
-				r.bodyLength = bodySize
+				r.bodyLength = int(decimalSize)
 				r.state = StateBodyChunkedWrite
 			case StateBodyChunkedWrite:
-				sIndex := bytes.Index(data[bytesRead:], []byte("\r\n"))
-				if sIndex == -1 {
-					return bytesRead, nil
+				// sidenote: chunk data is counted, never searched for a CRLF, since the data itself may contain one
+				n := copy(p[produced:], data[bytesRead:])
+				if n > r.bodyLength {
+					n = r.bodyLength
 				}
-				bodySize := sIndex - bytesRead
-				
-				if bodySize != r.bodyLength {
-					return bytesRead, fmt.Errorf("Error while parsing chunked body. Too many bytes sent")
+				if n == 0 {
+					break outer
+				}
+				bytesRead += n
+				produced += n
+				r.bodyLength -= n
+
+				if r.bodyLength == 0 {
+					r.state = StateBodyChunkedEnd
+				}
+			case StateBodyChunkedEnd:
+				if len(data[bytesRead:]) < 2 {
+					break outer
 				}
-				r.Body = append(r.Body, data[bytesRead: sIndex]...)
-				bytesRead += bodySize + 2
+				if !bytes.HasPrefix(data[bytesRead:], []byte("\r\n")) {
+					return bytesRead, produced, fmt.Errorf("%w: Chunk does not match its size", ErrMalformedBody)
+				}
+				bytesRead += 2
 				r.state = StateBodyChunkedRead
-			case StateDone:
+			case StateTrailers:
+				// sidenote: trailer fields go into their own set of headers, never into Headers. The headers were already acted upon before the body,
+				// so letting a trailer quietly change, say, the Content-Type after the fact would only invite trouble.
+				n, done, err := r.Trailer.Parse(data[bytesRead:])
+				if err != nil {
+					return bytesRead, produced, fmt.Errorf("%w: %w", ErrMalformedBody, err)
+				}
+				bytesRead += n
+				// without these a client could send trailer lines forever, and they pile up in Trailer whether the handler reads the body or not
+				r.trailerBytes += n
+				if r.trailerBytes > r.maxTrailerBytes {
+					return bytesRead, produced, fmt.Errorf("%w: Trailer section larger than %d bytes", ErrHeaderTooLarge, r.maxTrailerBytes)
+				}
+				if count := headerCount(&r.Trailer); count > r.maxTrailerCount {
+					return bytesRead, produced, fmt.Errorf("%w: %d trailer fields sent, at most %d allowed", ErrHeaderTooLarge, count, r.maxTrailerCount)
+				}
+				if !done {
+					break outer
+				}
+				r.state = StateDone
+			default:
 				break outer
 		}
 	}
-	return bytesRead, nil
+	return bytesRead, produced, nil
+}
 
+// sidenote: a RequestReader is what lets us keep a connection open between requests. The parser may pull in more bytes than the current request needs
+// (a client is allowed to pipeline its next request right behind the current one), so the buffer and whatever is left inside of it have to outlive a single request.
+type RequestReader struct {
+	reader io.Reader
+	buffer []byte
+	bSize int
+	// current is the last request handed out, whose body may still be streaming off the buffer
+	current *Request
+	// MaxHeaderBytes caps the size of the request line and headers of a request, CRLFs included. Zero means DefaultMaxHeaderBytes.
+	MaxHeaderBytes int
+	// MaxHeaderCount caps the number of header lines of a request. Zero means DefaultMaxHeaderCount.
+	MaxHeaderCount int
+	// ObsFold decides whether header values folded over several lines are rejected (the default) or joined back together.
+	ObsFold headers.FoldPolicy
 }
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
-	request := newRequest()
+// sidenote: the buffer starts small since nearly every request fits in it, and only grows (up to MaxHeaderBytes) for the odd request with a huge
+// cookie or header. Once the headers are in it shrinks back, so a single large request doesn't pin a megabyte to the connection for its lifetime.
+const defaultBufferSize = 1024
 
-	buffer := make([]byte, 1024)
-	bSize := 0
+const (
+	DefaultMaxHeaderBytes = 1 << 20
+	DefaultMaxHeaderCount = 100
+)
+
+func NewRequestReader(reader io.Reader) *RequestReader {
+	return &RequestReader{
+		reader: reader,
+		buffer: make([]byte, defaultBufferSize),
+		bSize: 0,
+	}
+}
+
+func (rr *RequestReader) maxHeaderBytes() int {
+	if rr.MaxHeaderBytes > 0 {
+		return rr.MaxHeaderBytes
+	}
+	return DefaultMaxHeaderBytes
+}
 
-	for request.state != StateDone {
-		n, err := reader.Read(buffer[bSize:])
+func (rr *RequestReader) maxHeaderCount() int {
+	if rr.MaxHeaderCount > 0 {
+		return rr.MaxHeaderCount
+	}
+	return DefaultMaxHeaderCount
+}
+
+// resize moves the unconsumed bytes into a buffer of the given size.
+func (rr *RequestReader) resize(size int) {
+	buffer := make([]byte, size)
+	copy(buffer, rr.buffer[:rr.bSize])
+	rr.buffer = buffer
+}
+
+// Buffered returns the number of bytes that have already been read from the underlying reader but not yet consumed by a request.
+func (rr *RequestReader) Buffered() int {
+	return rr.bSize
+}
+
+// Detach returns what is left to read of the underlying reader: the bytes read ahead into the buffer, then the reader itself. It is how a
+// hijacked connection gets back bytes the client sent right after its request. The RequestReader must not be used afterwards.
+func (rr *RequestReader) Detach() io.Reader {
+	buffered := make([]byte, rr.bSize)
+	copy(buffered, rr.buffer[:rr.bSize])
+	rr.bSize = 0
+	return io.MultiReader(bytes.NewReader(buffered), rr.reader)
+}
+
+// Ready blocks until at least one byte of the next request is available. It lets the server tell a connection that is sitting idle between requests
+// apart from one that is in the middle of sending one.
+func (rr *RequestReader) Ready() error {
+	for rr.bSize == 0 {
+		n, err := rr.reader.Read(rr.buffer)
+		rr.bSize += n
+		if err != nil && n == 0 {
+			return err
+		}
+	}
+	return nil
+}
+
+// consume drops the first n bytes of the buffer once the parser is done with them.
+func (rr *RequestReader) consume(n int) {
+	nCopy := copy(rr.buffer, rr.buffer[n: rr.bSize])
+	rr.bSize = nCopy
+}
+
+// fill reads more bytes from the underlying reader into the free space of the buffer. An error is only returned when no bytes came with it.
+func (rr *RequestReader) fill() error {
+	n, err := rr.reader.Read(rr.buffer[rr.bSize:])
+	rr.bSize += n
+	if err != nil && n == 0 {
+		return err
+	}
+	return nil
+}
+
+// ReadRequest parses the request line and headers of the next request on the reader and returns as soon as they are in. The body is left on the
+// connection for the handler to stream through BodyReader, and it has to be read to the end before the next call. If the reader is closed before
+// any byte of a new request has arrived, io.EOF is returned as is so that the caller can tell a clean close apart from a truncated request.
+func (rr *RequestReader) ReadRequest() (*Request, error) {
+	if rr.current != nil && rr.current.state != StateDone {
+		return nil, fmt.Errorf("Body of the previous request has not been read")
+	}
+	request := newRequest()
+	request.foldPolicy = rr.ObsFold
+	request.maxTrailerBytes = rr.maxHeaderBytes()
+	request.maxTrailerCount = rr.maxHeaderCount()
+	maxBytes := rr.maxHeaderBytes()
+	headerBytes := 0
+
+	for request.state == StateInit || request.state == StateHeaders {
+		numRead, err := request.parse(rr.buffer[:rr.bSize])
 		if err != nil {
-			if errors.Is(err, io.EOF){
-				if request.state == StateDone {	
-					return request, nil
+			return nil, err
+		}
+		rr.consume(numRead)
+		headerBytes += numRead
+		if headerBytes > maxBytes {
+			return nil, fmt.Errorf("%w: Request header section larger than %d bytes", ErrHeaderTooLarge, maxBytes)
+		}
+		if count := headerCount(&request.Headers); count > rr.maxHeaderCount() {
+			return nil, fmt.Errorf("%w: %d header fields sent, at most %d allowed", ErrHeaderTooLarge, count, rr.maxHeaderCount())
+		}
+
+		if request.state != StateInit && request.state != StateHeaders {
+			break
+		}
+
+		// a line that doesn't fit in the buffer gets a bigger buffer, as long as the header section can still end within the limit
+		if numRead == 0 && rr.bSize == len(rr.buffer) {
+			room := maxBytes - headerBytes
+			if len(rr.buffer) >= room {
+				return nil, fmt.Errorf("%w: Request header on line too long", ErrHeaderTooLarge)
+			}
+			rr.resize(min(2 * len(rr.buffer), room))
+		}
+
+		if err := rr.fill(); err != nil {
+			if errors.Is(err, io.EOF) {
+				if request.state == StateInit && rr.bSize == 0 {
+					return nil, io.EOF
 				}
 				return nil, io.ErrUnexpectedEOF
 			}
 			return nil, err
 		}
-		bSize += n
+	}
+	if len(rr.buffer) > defaultBufferSize && rr.bSize <= defaultBufferSize {
+		rr.resize(defaultBufferSize)
+	}
+
+	request.body = &bodyReader{reader: rr, request: request}
+	request.BodyReader = request.body
+	rr.current = request
+	return request, nil
+}
 
-		numRead, error :=  request.parse(buffer[:bSize])
-		if error != nil {
-			return nil, error
+// RequestFromReader parses exactly one request from the reader, body included, which ends up in Body. Unlike a RequestReader, which hands
+// leftover bytes to the next request, any bytes found after the end of the request are treated as an error.
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	requestReader := NewRequestReader(reader)
+	request, err := requestReader.ReadRequest()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := request.ReadBody(); err != nil {
+		return nil, err
+	}
+	if requestReader.Buffered() > 0 {
+		return nil, fmt.Errorf("Too many characters sent by request")
+	}
+	return request, nil
+}
+
+// Query decodes the query string of the request target. Malformed pairs are left out.
+func (r *Request) Query() Values {
+	values, _ := ParseQuery(r.URL.RawQuery)
+	return values
+}
+
+// PathValue returns the value of the named wildcard from the route pattern that matched this request, or "" when there is no such wildcard.
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+// LookupPathValue is PathValue, also reporting whether the route pattern had such a wildcard at all, since a catch-all may match an empty path.
+func (r *Request) LookupPathValue(name string) (string, bool) {
+	value, ok := r.pathValues[name]
+	return value, ok
+}
+
+// SetPathValue sets the value of a named wildcard. The mux calls it once it has matched a route, but it is also handy for building requests in tests.
+func (r *Request) SetPathValue(name string, value string) {
+	if r.pathValues == nil {
+		r.pathValues = map[string]string{}
+	}
+	r.pathValues[name] = value
+}
+
+// Context returns the context of the request. For requests coming in on a connection it is canceled when the client goes away or the handler
+// returns, whichever happens first, so a handler doing long work (or streaming events) can stop as soon as nobody is listening anymore.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// SetContext replaces the context of the request, e.g. to add a deadline or values in a middleware. A nil context panics.
+func (r *Request) SetContext(ctx context.Context) {
+	if ctx == nil {
+		panic("Nil context")
+	}
+	r.ctx = ctx
+}
+
+// KeepAlive reports whether the client expects the connection to stay open once this request has been answered. HTTP/1.1 connections are persistent
+// unless the client sends "Connection: close", while HTTP/1.0 connections are closed unless the client explicitly asks for "Connection: keep-alive".
+func (r *Request) KeepAlive() bool {
+	connection, _ := r.Headers.Get("Connection")
+	if r.RequestLine.HttpVersion == "1.0" {
+		return hasToken(connection, "keep-alive")
+	}
+	return !hasToken(connection, "close")
+}
+
+// parseContentLength accepts a Content-Length made of digits only. A list of identical values ("5, 5") is allowed since it is what a repeated
+// header turns into, anything else is rejected.
+func parseContentLength(value string) (int, error) {
+	parts := strings.Split(value, ",")
+	first := strings.TrimSpace(parts[0])
+	for _, part := range parts[1:] {
+		if strings.TrimSpace(part) != first {
+			return 0, fmt.Errorf("%w: Conflicting Content-Length values %q", ErrMalformedHeader, value)
+		}
+	}
+	if first == "" {
+		return 0, fmt.Errorf("%w: Empty Content-Length", ErrMalformedHeader)
+	}
+	for i := 0; i < len(first); i++ {
+		if first[i] < '0' || first[i] > '9' {
+			return 0, fmt.Errorf("%w: Invalid Content-Length %q", ErrMalformedHeader, value)
 		}
+	}
+	length, err := strconv.Atoi(first)
+	if err != nil {
+		return 0, fmt.Errorf("%w: Invalid Content-Length %q", ErrMalformedHeader, value)
+	}
+	return length, nil
+}
 
-		nCopy := copy(buffer, buffer[numRead: bSize])
-		bSize = nCopy
-		
-		
-		if numRead == 0 && bSize == len(buffer) {
-			return nil, fmt.Errorf("Request header on line too long")
+// headerCount counts the header lines of a request, a field sent on several lines counting once per line.
+func headerCount(h *headers.Headers) int {
+	count := 0
+	h.ForEach(func(key, value string) {
+		count++
+	})
+	return count
+}
+
+func hasToken(value string, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
 		}
 	}
+	return false
+}
 
-	return request, nil
+// Cookies parses the Cookie headers of the request. Malformed cookies are left out.
+func (r *Request) Cookies() []*cookie.Cookie {
+	var cookies []*cookie.Cookie
+	for _, line := range r.Headers.Values("Cookie") {
+		cookies = append(cookies, cookie.Parse(line)...)
+	}
+	return cookies
+}
+
+// Cookie returns the first cookie with the given name, or cookie.ErrNoCookie.
+func (r *Request) Cookie(name string) (*cookie.Cookie, error) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, cookie.ErrNoCookie
 }
@@ -3,7 +3,9 @@ package request
 import ( 
 	"testing"
 	"io"
+	"strconv"
 	"strings"
+	"github.com/juancruzfl/httpserver/internal/cookie"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -136,6 +138,29 @@ func TestParseRequestLine_TooManyTokens(t *testing.T) {
 
 }
 
+func TestParseRequestLine_LeadingEmptyLines(t *testing.T) {
+	reader := &chunkReader {
+		data: "\r\n\r\nGET /after HTTP/1.1\r\n\r\n",
+		chunkSize: 1,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "/after", r.RequestLine.RequestTarget)
+
+	// the stray CRLF some clients send after a POST body lands in front of the next request
+	requestReader := NewRequestReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\n\r\nok\r\nGET /next HTTP/1.1\r\nHost: localhost\r\n\r\n\r\n"))
+	r, err = requestReader.ReadRequest()
+	require.NoError(t, err)
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+	r, err = requestReader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.URL.Path)
+	_, err = requestReader.ReadRequest()
+	assert.ErrorIs(t, err, io.EOF, "a trailing empty line is not the start of a request")
+}
+
 func TestParseHeaders(t *testing.T) {
 	reader := &chunkReader {
 		data: "GET / HTTP/1.1\r\nHost: localhost:8000 \r\nUser-Agent: curl/0.0.0 \r\nAccept: */* \r\nTransfer-Encoding: chunked\r\n\r\n7\r\nWelcome\r\n1c\r\ntesttest test test test test\r\n0\r\n\r\n",
@@ -207,12 +232,55 @@ func TestHeaderTooLong(t *testing.T) {
         data:      "GET / HTTP/1.1\r\n" + longHeaderLine + "\r\n",
         chunkSize: 128,
     }
-    request, err := RequestFromReader(reader)
+    requestReader := NewRequestReader(reader)
+    requestReader.MaxHeaderBytes = 1024
+    request, err := requestReader.ReadRequest()
 
-    require.Error(t, err)
+    require.ErrorIs(t, err, ErrHeaderTooLarge)
 	assert.Nil(t, request)
 }
 
+func TestLongHeaderGrowsBuffer(t *testing.T) {
+	value := strings.Repeat("a", 5000)
+	reader := &chunkReader{
+		data:      "GET / HTTP/1.1\r\nHost: localhost\r\nCookie: " + value + "\r\n\r\nGET /next HTTP/1.1\r\n\r\n",
+		chunkSize: 700,
+	}
+	requestReader := NewRequestReader(reader)
+	request, err := requestReader.ReadRequest()
+	require.NoError(t, err)
+	cookie, _ := request.Headers.Get("Cookie")
+	assert.Equal(t, value, cookie)
+	assert.Equal(t, defaultBufferSize, len(requestReader.buffer), "the buffer should shrink back once the headers are in")
+
+	next, err := requestReader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", next.URL.Path)
+}
+
+func TestHeaderSectionLimit(t *testing.T) {
+	// every line fits in the buffer, but together they go over the limit
+	data := "GET / HTTP/1.1\r\n" + strings.Repeat("X-Filler: " + strings.Repeat("b", 90) + "\r\n", 30) + "\r\n"
+	requestReader := NewRequestReader(&chunkReader{data: data, chunkSize: 256})
+	requestReader.MaxHeaderBytes = 2048
+	requestReader.MaxHeaderCount = 1000
+	_, err := requestReader.ReadRequest()
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+}
+
+func TestHeaderCountLimit(t *testing.T) {
+	data := "GET / HTTP/1.1\r\n" + strings.Repeat("X-A: 1\r\n", 4) + "\r\n"
+	requestReader := NewRequestReader(strings.NewReader(data))
+	requestReader.MaxHeaderCount = 3
+	_, err := requestReader.ReadRequest()
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	requestReader = NewRequestReader(strings.NewReader(data))
+	requestReader.MaxHeaderCount = 4
+	_, err = requestReader.ReadRequest()
+	assert.NoError(t, err)
+}
+
 func TestDuplicateHeaders(t *testing.T) {
     reader := &chunkReader{
         data:      "GET / HTTP/1.1\r\nHost: localhost\r\nSet-Cookie: ID=1\r\nSet-Cookie: User=Admin\r\n\r\n",
@@ -225,3 +293,370 @@ func TestDuplicateHeaders(t *testing.T) {
     assert.True(t, ok)
     assert.Equal(t, "ID=1, User=Admin", cookie)
 }
+
+func TestRequestReaderKeepsLeftoverBytes(t *testing.T) {
+	reader := &chunkReader{
+		data:      "POST /first HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhelloGET /second HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		chunkSize: 64,
+	}
+	requestReader := NewRequestReader(reader)
+
+	first, err := requestReader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", first.RequestLine.RequestTarget)
+	body, err := first.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	second, err := requestReader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", second.RequestLine.RequestTarget)
+
+	_, err = requestReader.ReadRequest()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestRequestReaderTruncatedRequest(t *testing.T) {
+	reader := &chunkReader{
+		data:      "GET / HTTP/1.1\r\nHost: loc",
+		chunkSize: 4,
+	}
+	_, err := NewRequestReader(reader).ReadRequest()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestKeepAlive(t *testing.T) {
+	cases := []struct {
+		version    string
+		connection string
+		expected   bool
+	}{
+		{"1.1", "", true},
+		{"1.1", "close", false},
+		{"1.1", "Keep-Alive, Close", false},
+		{"1.0", "", false},
+		{"1.0", "keep-alive", true},
+	}
+	for _, c := range cases {
+		reader := &chunkReader{
+			data:      "GET / HTTP/" + c.version + "\r\nHost: localhost\r\nConnection: " + c.connection + "\r\n\r\n",
+			chunkSize: 16,
+		}
+		r, err := RequestFromReader(reader)
+		require.NoError(t, err)
+		assert.Equal(t, c.expected, r.KeepAlive(), "HTTP/%s Connection: %q", c.version, c.connection)
+	}
+}
+
+func TestParseErrorsAreTyped(t *testing.T) {
+	cases := []struct {
+		data     string
+		expected error
+	}{
+		{"GET /\r\n\r\n", ErrMalformedRequestLine},
+		{"get / HTTP/1.1\r\n\r\n", ErrMalformedRequestLine},
+		{"GET index.html HTTP/1.1\r\n\r\n", ErrMalformedRequestLine},
+		{"GET / HTTX/1.1\r\n\r\n", ErrMalformedRequestLine},
+		{"GET / HTTP/2\r\n\r\n", ErrMalformedRequestLine},
+		{"GET / HTTP/2.0\r\n\r\n", ErrUnsupportedVersion},
+		{"GET / HTTP/1.1\r\nHost : localhost\r\n\r\n", ErrMalformedHeader},
+		{"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: ten\r\n\r\n", ErrMalformedHeader},
+		{"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: -1\r\n\r\n", ErrMalformedHeader},
+		{"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nab", ErrMalformedHeader},
+		{"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1\r\nTransfer-Encoding: chunked\r\n\r\n", ErrMalformedHeader},
+		{"POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: gzip\r\n\r\n", ErrUnsupportedTransferEncoding},
+		{"POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", ErrMalformedBody},
+		{"GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", DefaultMaxHeaderBytes) + "\r\n\r\n", ErrHeaderTooLarge},
+	}
+	for _, c := range cases {
+		reader := &chunkReader{
+			data:      c.data,
+			chunkSize: 64,
+		}
+		r, err := RequestFromReader(reader)
+		assert.ErrorIs(t, err, c.expected, "request %q", c.data)
+		assert.Nil(t, r)
+	}
+}
+
+func TestRepeatedIdenticalContentLength(t *testing.T) {
+	reader := &chunkReader{
+		data:      "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\nContent-Length: 2\r\n\r\nok",
+		chunkSize: 8,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(r.Body))
+}
+
+func TestBodyIsStreamed(t *testing.T) {
+	reader := &chunkReader{
+		data:      "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3000\r\n\r\n" + strings.Repeat("x", 3000),
+		chunkSize: 512,
+	}
+	r, err := NewRequestReader(reader).ReadRequest()
+	require.NoError(t, err)
+	assert.Nil(t, r.Body)
+	assert.Less(t, reader.pos, 3000, "the body should not have been read before the handler asks for it")
+
+	data, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("x", 3000), string(data))
+	assert.Equal(t, StateDone, r.state)
+}
+
+func TestChunkedBodyIsStreamed(t *testing.T) {
+	reader := &chunkReader{
+		data:      "POST /upload HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhe\r\nl\r\n3\r\nlo!\r\n0\r\n\r\nGET /next HTTP/1.1\r\n\r\n",
+		chunkSize: 3,
+	}
+	requestReader := NewRequestReader(reader)
+	r, err := requestReader.ReadRequest()
+	require.NoError(t, err)
+
+	buffer := make([]byte, 2)
+	var body []byte
+	for {
+		n, err := r.BodyReader.Read(buffer)
+		body = append(body, buffer[:n]...)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "he\r\nllo!", string(body))
+
+	next, err := requestReader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", next.URL.Path)
+}
+
+func TestTruncatedBody(t *testing.T) {
+	reader := &chunkReader{
+		data:      "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc",
+		chunkSize: 8,
+	}
+	r, err := NewRequestReader(reader).ReadRequest()
+	require.NoError(t, err)
+
+	_, err = io.ReadAll(r.BodyReader)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestReadAfterClose(t *testing.T) {
+	reader := &chunkReader{
+		data:      "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nbody",
+		chunkSize: 8,
+	}
+	r, err := NewRequestReader(reader).ReadRequest()
+	require.NoError(t, err)
+	require.NoError(t, r.BodyReader.Close())
+
+	_, err = r.BodyReader.Read(make([]byte, 4))
+	assert.ErrorIs(t, err, ErrBodyReadAfterClose)
+	assert.True(t, r.DiscardBody(1024))
+}
+
+func TestDiscardBodyLimit(t *testing.T) {
+	reader := &chunkReader{
+		data:      "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5000\r\n\r\n" + strings.Repeat("y", 5000),
+		chunkSize: 1024,
+	}
+	r, err := NewRequestReader(reader).ReadRequest()
+	require.NoError(t, err)
+	assert.False(t, r.DiscardBody(1000))
+}
+
+func TestNextRequestNeedsBodyRead(t *testing.T) {
+	reader := &chunkReader{
+		data:      "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nbodyGET / HTTP/1.1\r\n\r\n",
+		chunkSize: 8,
+	}
+	requestReader := NewRequestReader(reader)
+	first, err := requestReader.ReadRequest()
+	require.NoError(t, err)
+
+	_, err = requestReader.ReadRequest()
+	assert.Error(t, err)
+
+	assert.True(t, first.DiscardBody(1024))
+	second, err := requestReader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "GET", second.RequestLine.Method)
+}
+
+func TestBodyLimitRefusesLargeContentLength(t *testing.T) {
+	reader := &chunkReader{
+		data:      "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5000\r\n\r\n" + strings.Repeat("y", 5000),
+		chunkSize: 1024,
+	}
+	r, err := NewRequestReader(reader).ReadRequest()
+	require.NoError(t, err)
+	called := false
+	r.SetBodyLimit(100)
+	r.OnBodyLimit(func() { called = true })
+
+	n, err := r.BodyReader.Read(make([]byte, 10))
+	assert.Equal(t, 0, n)
+	var maxErr *MaxBytesError
+	require.ErrorAs(t, err, &maxErr)
+	assert.Equal(t, int64(100), maxErr.Limit)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.True(t, called)
+	assert.False(t, r.DiscardBody(1 << 20))
+}
+
+func TestBodyLimitOnChunkedBody(t *testing.T) {
+	reader := &chunkReader{
+		data:      "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nabcd\r\n4\r\nefgh\r\n0\r\n\r\n",
+		chunkSize: 5,
+	}
+	r, err := NewRequestReader(reader).ReadRequest()
+	require.NoError(t, err)
+	r.SetBodyLimit(6)
+
+	data, err := io.ReadAll(r.BodyReader)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.Equal(t, "abcdef", string(data))
+}
+
+func TestBodyExactlyAtLimit(t *testing.T) {
+	reader := &chunkReader{
+		data:      "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nabcd\r\n0\r\n\r\n",
+		chunkSize: 5,
+	}
+	r, err := NewRequestReader(reader).ReadRequest()
+	require.NoError(t, err)
+	r.SetBodyLimit(4)
+
+	data, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "abcd", string(data))
+}
+
+func TestOnBodyDone(t *testing.T) {
+	reader := &chunkReader{
+		data:      "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\n0123456789GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		chunkSize: 4,
+	}
+	requestReader := NewRequestReader(reader)
+	r, err := requestReader.ReadRequest()
+	require.NoError(t, err)
+	done := 0
+	r.OnBodyDone(func() { done++ })
+	assert.Equal(t, 0, done, "the body has not been read yet")
+	_, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, 1, done)
+	r.BodyReader.Read(make([]byte, 1))
+	assert.Equal(t, 1, done, "the body only ends once")
+
+	// a request without a body is done from the start
+	r, err = requestReader.ReadRequest()
+	require.NoError(t, err)
+	r.OnBodyDone(func() { done++ })
+	assert.Equal(t, 2, done)
+	assert.NoError(t, r.Context().Err())
+
+	// reading exactly the body ends it, without a read coming back for the EOF
+	for _, chunkSize := range []int{4, 1024} {
+		requestReader = NewRequestReader(&chunkReader{data: "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello", chunkSize: chunkSize})
+		r, err = requestReader.ReadRequest()
+		require.NoError(t, err)
+		done = 0
+		r.OnBodyDone(func() { done++ })
+		_, err = io.ReadFull(r.BodyReader, make([]byte, 5))
+		require.NoError(t, err)
+		assert.Equal(t, 1, done)
+	}
+}
+
+func TestChunkedBodyAcrossReadBoundaries(t *testing.T) {
+	// binary chunk data containing CRLFs, extensions and a trailer section, read a byte at a time up to all at once
+	data := "POST /upload HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"6;name=val\r\n\r\n\x00\xff\r\n\r\n" +
+		"A ; a ; b=\"q;\\\"uoted\"\r\n0123456789\r\n" +
+		"0\r\nChecksum: abc\r\nExpires: never\r\n\r\n" +
+		"GET /next HTTP/1.1\r\n\r\n"
+	for chunkSize := 1; chunkSize <= len(data); chunkSize++ {
+		requestReader := NewRequestReader(&chunkReader{data: data, chunkSize: chunkSize})
+		r, err := requestReader.ReadRequest()
+		require.NoError(t, err)
+
+		body, err := r.ReadBody()
+		require.NoError(t, err, "chunk size %d", chunkSize)
+		assert.Equal(t, "\r\n\x00\xff\r\n0123456789", string(body))
+		checksum, _ := r.Trailer.Get("Checksum")
+		assert.Equal(t, "abc", checksum)
+		expires, _ := r.Trailer.Get("Expires")
+		assert.Equal(t, "never", expires)
+		_, ok := r.Headers.Get("Checksum")
+		assert.False(t, ok, "trailers should not end up in the headers")
+
+		next, err := requestReader.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, "/next", next.URL.Path)
+	}
+}
+
+func TestInvalidChunkLines(t *testing.T) {
+	lines := []string{"+5", "-5", "0x5", " 5", "", "5;", "5;=x", "5;a=", "5 x", "5;a=\"open", "11111111111111111"}
+	for _, line := range lines {
+		r, err := NewRequestReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" + line + "\r\nhello\r\n0\r\n\r\n")).ReadRequest()
+		require.NoError(t, err)
+		_, err = r.ReadBody()
+		assert.ErrorIs(t, err, ErrMalformedBody, "chunk line %q", line)
+	}
+}
+
+func TestMalformedTrailer(t *testing.T) {
+	r, err := NewRequestReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nbad trailer\r\n\r\n")).ReadRequest()
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	assert.ErrorIs(t, err, ErrMalformedBody)
+}
+
+func TestTrailerLimits(t *testing.T) {
+	var trailers strings.Builder
+	for i := 0; i < 20; i++ {
+		trailers.WriteString("X-Trailer-" + strconv.Itoa(i) + ": " + strings.Repeat("v", 50) + "\r\n")
+	}
+	data := "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n" + trailers.String() + "\r\n"
+
+	requestReader := NewRequestReader(&chunkReader{data: data, chunkSize: 64})
+	requestReader.MaxHeaderCount = 10
+	r, err := requestReader.ReadRequest()
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+	assert.LessOrEqual(t, r.Trailer.Len(), 20)
+
+	requestReader = NewRequestReader(&chunkReader{data: data, chunkSize: 64})
+	requestReader.MaxHeaderBytes = 512
+	r, err = requestReader.ReadRequest()
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// within both limits the trailer comes through
+	r, err = NewRequestReader(&chunkReader{data: data, chunkSize: 64}).ReadRequest()
+	require.NoError(t, err)
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(body))
+	assert.Equal(t, 20, r.Trailer.Len())
+}
+
+func TestCookies(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nCookie: a=1; b=2\r\nCookie: c=3\r\n\r\n"))
+	require.NoError(t, err)
+
+	cookies := r.Cookies()
+	require.Len(t, cookies, 3)
+	assert.Equal(t, "c", cookies[2].Name)
+	c, err := r.Cookie("b")
+	require.NoError(t, err)
+	assert.Equal(t, "2", c.Value)
+	_, err = r.Cookie("missing")
+	assert.ErrorIs(t, err, cookie.ErrNoCookie)
+}
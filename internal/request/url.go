@@ -0,0 +1,155 @@
+package request
+
+import (
+	"fmt"
+	"strings"
+)
+
+// URL is the request target split into its parts. Path is percent-decoded and normalized, which is what routing works on, while RawPath and
+// RawQuery keep the bytes exactly as the client sent them.
+type URL struct {
+	Path string
+	RawPath string
+	RawQuery string
+}
+
+// Values maps a query (or form) parameter to every value it was given, in the order they appeared.
+type Values map[string][]string
+
+// Get returns the first value for the key, or "" if there is none.
+func (v Values) Get(key string) string {
+	values := v[key]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// All returns every value for the key.
+func (v Values) All(key string) []string {
+	return v[key]
+}
+
+// Has reports whether the key was given at all, even with an empty value.
+func (v Values) Has(key string) bool {
+	_, ok := v[key]
+	return ok
+}
+
+func (v Values) Add(key string, value string) {
+	v[key] = append(v[key], value)
+}
+
+func (v Values) Set(key string, value string) {
+	v[key] = []string{value}
+}
+
+// ParseQuery decodes a query string of the form "a=1&b=2&a=3". Both the keys and the values are percent-decoded and '+' stands for a space.
+// Pairs that can't be decoded are skipped and the first error met is returned along with everything that could be decoded.
+func ParseQuery(query string) (Values, error) {
+	values := Values{}
+	var firstErr error
+	for query != "" {
+		var pair string
+		pair, query, _ = strings.Cut(query, "&")
+		if pair == "" {
+			continue
+		}
+		rawKey, rawValue, _ := strings.Cut(pair, "=")
+		key, err := unescape(rawKey, true)
+		if err == nil {
+			var value string
+			value, err = unescape(rawValue, true)
+			if err == nil {
+				values.Add(key, value)
+				continue
+			}
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return values, firstErr
+}
+
+// parseRequestTarget splits an origin-form target ("/path?query") and works out the decoded, normalized path.
+func parseRequestTarget(target string) (URL, error) {
+	rawPath, rawQuery, _ := strings.Cut(target, "?")
+	decoded, err := unescape(rawPath, false)
+	if err != nil {
+		return URL{}, err
+	}
+	return URL{
+		Path: cleanPath(decoded),
+		RawPath: rawPath,
+		RawQuery: rawQuery,
+	}, nil
+}
+
+func unhex(char byte) (byte, bool) {
+	switch {
+	case char >= '0' && char <= '9':
+		return char - '0', true
+	case char >= 'a' && char <= 'f':
+		return char - 'a' + 10, true
+	case char >= 'A' && char <= 'F':
+		return char - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// unescape decodes %XX sequences. In a query, '+' is also turned into a space.
+func unescape(s string, query bool) (string, error) {
+	if !strings.ContainsAny(s, "%+") {
+		return s, nil
+	}
+	var decoded strings.Builder
+	decoded.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '%':
+			if i+2 >= len(s) {
+				return "", fmt.Errorf("Invalid escape %q", s[i:])
+			}
+			high, okHigh := unhex(s[i+1])
+			low, okLow := unhex(s[i+2])
+			if !okHigh || !okLow {
+				return "", fmt.Errorf("Invalid escape %q", s[i:i+3])
+			}
+			decoded.WriteByte(high<<4 | low)
+			i += 2
+		case s[i] == '+' && query:
+			decoded.WriteByte(' ')
+		default:
+			decoded.WriteByte(s[i])
+		}
+	}
+	return decoded.String(), nil
+}
+
+// cleanPath collapses repeated slashes and resolves "." and ".." segments, so that "/a//b/../c" and "/a/c" route to the same place and a
+// path can never climb above the root. A trailing slash is kept since "/dir/" and "/dir" are different routes.
+func cleanPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	var segments []string
+	for _, segment := range strings.Split(path, "/") {
+		switch segment {
+		case "", ".":
+		case "..":
+			if len(segments) > 0 {
+				segments = segments[:len(segments)-1]
+			}
+		default:
+			segments = append(segments, segment)
+		}
+	}
+
+	cleaned := "/" + strings.Join(segments, "/")
+	last := path[strings.LastIndex(path, "/")+1:]
+	if cleaned != "/" && (last == "" || last == "." || last == "..") {
+		cleaned += "/"
+	}
+	return cleaned
+}
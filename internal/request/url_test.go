@@ -0,0 +1,85 @@
+package request
+
+import (
+	"testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRequestTarget(t *testing.T) {
+	cases := []struct {
+		target   string
+		path     string
+		rawPath  string
+		rawQuery string
+	}{
+		{"/", "/", "/", ""},
+		{"/search?q=test&lang=en", "/search", "/search", "q=test&lang=en"},
+		{"/caf%C3%A9/menu", "/café/menu", "/caf%C3%A9/menu", ""},
+		{"/a//b/./c/../d", "/a/b/d", "/a//b/./c/../d", ""},
+		{"/../../etc/passwd", "/etc/passwd", "/../../etc/passwd", ""},
+		{"/static/%2e%2e/%2e%2e/secret", "/secret", "/static/%2e%2e/%2e%2e/secret", ""},
+		{"/dir/", "/dir/", "/dir/", ""},
+		{"/dir/sub/..", "/dir/", "/dir/sub/..", ""},
+		{"/a+b?x=1?y", "/a+b", "/a+b", "x=1?y"},
+	}
+	for _, c := range cases {
+		url, err := parseRequestTarget(c.target)
+		require.NoError(t, err, c.target)
+		assert.Equal(t, c.path, url.Path, c.target)
+		assert.Equal(t, c.rawPath, url.RawPath, c.target)
+		assert.Equal(t, c.rawQuery, url.RawQuery, c.target)
+	}
+}
+
+func TestParseRequestTargetBadEscape(t *testing.T) {
+	for _, target := range []string{"/%zz", "/abc%", "/abc%4"} {
+		_, err := parseRequestTarget(target)
+		assert.Error(t, err, target)
+	}
+
+	reader := &chunkReader{
+		data:      "GET /bad%zzpath HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		chunkSize: 8,
+	}
+	_, err := RequestFromReader(reader)
+	assert.ErrorIs(t, err, ErrMalformedRequestLine)
+}
+
+func TestParseQuery(t *testing.T) {
+	values, err := ParseQuery("q=hello+world&tag=a&tag=b%26c&empty=&flag&=novalue&&caf%C3%A9=%E2%9C%93")
+	require.NoError(t, err)
+
+	assert.Equal(t, "hello world", values.Get("q"))
+	assert.Equal(t, []string{"a", "b&c"}, values.All("tag"))
+	assert.Equal(t, "a", values.Get("tag"))
+	assert.True(t, values.Has("empty"))
+	assert.Equal(t, "", values.Get("empty"))
+	assert.True(t, values.Has("flag"))
+	assert.Equal(t, "✓", values.Get("café"))
+	assert.Equal(t, "novalue", values.Get(""))
+	assert.False(t, values.Has("missing"))
+	assert.Nil(t, values.All("missing"))
+}
+
+func TestParseQueryKeepsGoodPairs(t *testing.T) {
+	values, err := ParseQuery("a=1&b=%zz&c=3")
+	assert.Error(t, err)
+	assert.Equal(t, "1", values.Get("a"))
+	assert.False(t, values.Has("b"))
+	assert.Equal(t, "3", values.Get("c"))
+}
+
+func TestRequestQuery(t *testing.T) {
+	reader := &chunkReader{
+		data:      "GET /search?q=test&lang=en&lang=es HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		chunkSize: 5,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+
+	assert.Equal(t, "/search?q=test&lang=en&lang=es", r.RequestLine.RequestTarget)
+	assert.Equal(t, "/search", r.URL.Path)
+	assert.Equal(t, "test", r.Query().Get("q"))
+	assert.Equal(t, []string{"en", "es"}, r.Query().All("lang"))
+}
@@ -0,0 +1,56 @@
+package response
+
+import (
+	"io"
+	"github.com/juancruzfl/httpserver/internal/request"
+)
+
+type maxBytesReader struct {
+	w ResponseWriter
+	r io.ReadCloser
+	remaining int64
+	limit int64
+	err error
+}
+
+// MaxBytesReader limits reading from r to n bytes. Reading past the limit returns a *request.MaxBytesError, answers the request with a
+// 413 Content Too Large (unless the handler already picked a status) and makes the response close the connection, since the rest of the body is
+// never read. It is meant for bodies the server can't limit on its own, like the output of a decompressor.
+func MaxBytesReader(w ResponseWriter, r io.ReadCloser, n int64) io.ReadCloser {
+	if n < 0 {
+		n = 0
+	}
+	return &maxBytesReader{w: w, r: r, remaining: n, limit: n}
+}
+
+func (l *maxBytesReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// sidenote: we read one byte more than we are allowed to, so that a body of exactly the limit is told apart from one that goes over it
+	if int64(len(p)) - 1 > l.remaining {
+		p = p[:l.remaining + 1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) <= l.remaining {
+		l.remaining -= int64(n)
+		l.err = err
+		return n, err
+	}
+
+	n = int(l.remaining)
+	l.remaining = 0
+	l.err = &request.MaxBytesError{Limit: l.limit}
+	l.w.CustomWriteHeader(StatusContentTooLarge)
+	if res, ok := l.w.(interface{ DisableKeepAlive() }); ok {
+		res.DisableKeepAlive()
+	}
+	return n, l.err
+}
+
+func (l *maxBytesReader) Close() error {
+	return l.r.Close()
+}
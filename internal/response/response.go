@@ -1,9 +1,17 @@
 package response
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/juancruzfl/httpserver/internal/cookie"
 	"github.com/juancruzfl/httpserver/internal/headers"
+	"github.com/juancruzfl/httpserver/internal/request"
 )
 // sidenote: In the offical documentation for the net/http package, GetHeaders is called Headers and it returns the map of Headers.
 // However, in my implementation we will just return a pointer to the Header struct and then use our methods to access the map.
@@ -13,6 +21,28 @@ type ResponseWriter interface {
 	CustomWriteHeader(int)
 }
 
+// Flusher is implemented by response writers that can send what has been written so far right away, instead of holding it back until the
+// handler returns. Handlers streaming to the client check for it with a type assertion, since wrappers of a ResponseWriter may not support it.
+type Flusher interface {
+	Flush() error
+}
+
+// Hijacker is implemented by response writers that can hand the connection over to the handler, for protocols like WebSocket that take over
+// the connection once the HTTP exchange is done.
+type Hijacker interface {
+	Hijack() (net.Conn, *bufio.ReadWriter, error)
+}
+
+// ErrHijacked is returned when a response is used after its connection has been hijacked, or hijacked twice.
+var ErrHijacked = errors.New("Connection has been hijacked")
+
+// ErrContentLength is returned by Write when the handler writes more bytes than the Content-Length it declared.
+var ErrContentLength = errors.New("Wrote more than the declared Content-Length")
+
+// bufferSize is how much of the body we hold back before sending the headers. A body that fits entirely gets an exact Content-Length, a
+// larger one is sent with chunked framing as it is written.
+const bufferSize = 4096
+
 type StatusLine struct {
 	Status int
 	HttpVersion string
@@ -21,10 +51,23 @@ type StatusLine struct {
 
 type Response struct {
 	conn net.Conn
+	writer *bufio.Writer
 	StatusLine StatusLine
 	Headers *headers.Headers
+	// Body holds what the handler has written but has not been sent yet, at most bufferSize bytes.
 	Body []byte
+	// WritingState reports whether the status line and the headers have been sent to the client.
 	WritingState bool
+	wroteHeader bool
+	chunked bool
+	declaredLength int64
+	written int64
+	httpVersion string
+	method string
+	keepAlive bool
+	hijacked bool
+	// onHijack is set by the server. It stops the server from reading the connection and returns what is left to read of it.
+	onHijack func() io.Reader
 }
 
 // this is a similar to our Get function, except we return the header struct, again as a pointer to avoid large copies, instead of an individual one
@@ -32,60 +75,288 @@ func (r *Response) GetHeaders() *headers.Headers {
 	return r.Headers
 }
 
-// sidenote: I am not implementing the full range of status codes. There are too many to do in a short amount of time I have but the essential status codes that are needed for the response to fail or continue
-// will take priority.
+// CustomWriteHeader sets the status of the response. Only the first call has any effect, and the headers should not be changed afterwards.
+// It panics if the status is not a three digit code, since there is no way to put such a code on the status line.
+//
+// sidenote: nothing is sent yet at this point. The status line and headers go out together with the first part of the body, which is what lets
+// us work out the framing of the body for the handler.
 func (r *Response) CustomWriteHeader(status int) {
-	if r.WritingState {
+	if r.wroteHeader || r.hijacked {
 		return 
 	}
-	var phrase string
-    switch status {
-    case 200:
-		phrase = "OK"
-    case 201: 
-		phrase = "Created"
-    case 400: 
-		phrase = "Bad Request"
-    case 404: 
-		phrase = "Not Found"
-    case 501: 
-		phrase = "Internal Server Error"
-    default:  
-		phrase = "OK"
-    }
-	statusLine := fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, phrase)
-	r.conn.Write([]byte(statusLine))
+	if !validStatus(status) {
+		panic(fmt.Sprintf("Invalid status code %d", status))
+	}
 	r.StatusLine.Status = status
-	r.StatusLine.StatusPhrase = phrase
-
-	requestHeaders := r.Headers
-	
-	requestHeaders.ForEach(func(key, value string) {
-		headerLine := fmt.Sprintf("%s: %s\r\n", key, value)
-		r.conn.Write([]byte(headerLine))
-	})
-	// this seperator is used to keep our headers seperate from our body when writing the resonse
-	r.conn.Write([]byte("\r\n"))
-	r.WritingState = true
+	r.StatusLine.StatusPhrase = StatusText(status)
+	r.wroteHeader = true
 }
 
 func (r *Response) Write(data []byte) (int, error) {
+	if r.hijacked {
+		return 0, ErrHijacked
+	}
+	if !r.wroteHeader {
+		r.CustomWriteHeader(200)
+	}
+	if !r.statusAllowsBody() {
+		return 0, fmt.Errorf("Response with status %d can't have a body", r.StatusLine.Status)
+	}
+
 	if !r.WritingState {
+		if declared, ok := r.contentLengthHeader(); ok && int64(len(r.Body) + len(data)) > declared && r.bodyAllowed() {
+			return 0, ErrContentLength
+		}
+		r.Body = append(r.Body, data...)
+		if len(r.Body) <= bufferSize {
+			return len(data), nil
+		}
+		if err := r.sendHeader(false); err != nil {
+			return 0, err
+		}
+		pending := r.Body
+		r.Body = nil
+		if _, err := r.writeBody(pending); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	return r.writeBody(data)
+}
+
+// Flush sends the headers, if they have not been sent yet, along with everything written so far. Once a response has been flushed its length is
+// no longer known, so unless the handler set a Content-Length the rest of the body is sent in chunks.
+func (r *Response) Flush() error {
+	if r.hijacked {
+		return ErrHijacked
+	}
+	if !r.wroteHeader {
 		r.CustomWriteHeader(200)
 	}
-	n, err := r.conn.Write(data)
+	if !r.WritingState {
+		if err := r.sendHeader(false); err != nil {
+			return err
+		}
+		pending := r.Body
+		r.Body = nil
+		if _, err := r.writeBody(pending); err != nil {
+			return err
+		}
+	}
+	return r.writer.Flush()
+}
+
+// Finish completes the response once the handler has returned. A body that never left the buffer is sent with its exact Content-Length, a
+// chunked body gets its last chunk, and a handler that never wrote anything still gets a status line, answered as an empty 200.
+func (r *Response) Finish() error {
+	if r.hijacked {
+		return nil
+	}
+	if !r.wroteHeader {
+		r.CustomWriteHeader(200)
+	}
+	if !r.WritingState {
+		if err := r.sendHeader(true); err != nil {
+			return err
+		}
+		pending := r.Body
+		r.Body = nil
+		if _, err := r.writeBody(pending); err != nil {
+			return err
+		}
+	}
+	if r.chunked && r.bodyAllowed() {
+		if _, err := r.writer.WriteString("0\r\n\r\n"); err != nil {
+			return err
+		}
+	}
+	// a body shorter than the Content-Length the handler promised leaves the client waiting for bytes that will never come, so the only way to
+	// end the response is to close the connection
+	if r.declaredLength >= 0 && r.written < r.declaredLength && r.bodyAllowed() {
+		r.keepAlive = false
+	}
+	return r.writer.Flush()
+}
+
+// writeBody puts body bytes on the wire using the framing chosen in sendHeader. Bodies of HEAD responses are dropped here, after they have
+// been counted towards the Content-Length.
+func (r *Response) writeBody(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	// sidenote: a HEAD request is answered by the GET handler, so the handler will happily write a body. The client is not expecting one,
+	// so we pretend it was written and throw it away.
+	if !r.bodyAllowed() {
+		return len(data), nil
+	}
+	if r.declaredLength >= 0 && r.written + int64(len(data)) > r.declaredLength {
+		return 0, ErrContentLength
+	}
+	r.written += int64(len(data))
+
+	if r.chunked {
+		if _, err := fmt.Fprintf(r.writer, "%x\r\n", len(data)); err != nil {
+			return 0, fmt.Errorf("Error while to trying to write to response: %w ", err)
+		}
+	}
+	n, err := r.writer.Write(data)
 	if err != nil {
-		fmt.Errorf("Error while to trying to write to response: %w ", err)
+		return n, fmt.Errorf("Error while to trying to write to response: %w ", err)
+	}
+	if r.chunked {
+		if _, err := r.writer.WriteString("\r\n"); err != nil {
+			return n, fmt.Errorf("Error while to trying to write to response: %w ", err)
+		}
 	}
 	return n, nil
 }
 
+// sendHeader decides how the body is framed and writes the status line and the headers. When final is true the whole body is sitting in the
+// buffer, so its length is known.
+//
+// sidenote: the client can only find the end of our body without us closing the socket if we tell it where the body ends. We prefer an exact
+// Content-Length, fall back to chunked encoding for bodies we can't see the end of, and only close the connection for HTTP/1.0 clients which
+// don't understand chunks.
+func (r *Response) sendHeader(final bool) error {
+	_, hasLength := r.Headers.Get("Content-Length")
+	transferEncoding, hasTransferEncoding := r.Headers.Get("Transfer-Encoding")
+
+	r.declaredLength = -1
+	switch {
+	case hasLength:
+		if length, ok := r.contentLengthHeader(); ok {
+			r.declaredLength = length
+		} else {
+			r.keepAlive = false
+		}
+	case hasTransferEncoding:
+		if strings.EqualFold(transferEncoding, "chunked") && r.httpVersion != "1.0" {
+			r.chunked = true
+		} else {
+			r.keepAlive = false
+		}
+	case !r.statusAllowsBody():
+	// a HEAD handler that wrote nothing and declared no length may be leaving the length out on purpose, e.g. for a body that gets compressed
+	// on the way, so we don't claim an empty one
+	case final && r.method == "HEAD" && len(r.Body) == 0:
+	case final:
+		r.Headers.Set("Content-Length", strconv.Itoa(len(r.Body)))
+		r.declaredLength = int64(len(r.Body))
+	case r.httpVersion == "1.0":
+		r.keepAlive = false
+	default:
+		r.Headers.Set("Transfer-Encoding", "chunked")
+		r.chunked = true
+	}
+	r.prepareConnectionHeader()
+
+	statusLine := fmt.Sprintf("HTTP/1.1 %d %s\r\n", r.StatusLine.Status, r.StatusLine.StatusPhrase)
+	r.writer.WriteString(statusLine)
+	// sidenote: fields with CR, LF or other control characters in them are dropped here rather than sent, so a handler echoing user input into a
+	// header can't be tricked into splitting the response
+	if err := r.Headers.Write(r.writer); err != nil && !errors.Is(err, headers.ErrInvalidField) {
+		return fmt.Errorf("Error while to trying to write to response: %w ", err)
+	}
+	// this seperator is used to keep our headers seperate from our body when writing the resonse
+	_, err := r.writer.WriteString("\r\n")
+	r.WritingState = true
+	if err != nil {
+		return fmt.Errorf("Error while to trying to write to response: %w ", err)
+	}
+	return nil
+}
+
+// contentLengthHeader returns the Content-Length the handler set, if it set a valid one.
+func (r *Response) contentLengthHeader() (int64, bool) {
+	contentLength, ok := r.Headers.Get("Content-Length")
+	if !ok {
+		return 0, false
+	}
+	length, err := strconv.ParseInt(contentLength, 10, 64)
+	if err != nil || length < 0 {
+		return 0, false
+	}
+	return length, true
+}
+
+func (r *Response) prepareConnectionHeader() {
+	connection, _ := r.Headers.Get("Connection")
+	if strings.EqualFold(connection, "close") {
+		r.keepAlive = false
+	}
+
+	if !r.keepAlive {
+		if !strings.EqualFold(connection, "close") {
+			r.Headers.Set("Connection", "close")
+		}
+	} else if r.httpVersion == "1.0" && connection == "" {
+		r.Headers.Set("Connection", "keep-alive")
+	}
+}
+
+// statusAllowsBody reports whether responses with this status may carry a body. 1xx, 204 and 304 responses never do.
+func (r *Response) statusAllowsBody() bool {
+	status := r.StatusLine.Status
+	return !(status >= 100 && status < 200) && status != 204 && status != 304
+}
+
+// bodyAllowed reports whether body bytes actually go on the wire. On top of the status rules, responses to HEAD requests never carry one.
+func (r *Response) bodyAllowed() bool {
+	return r.method != "HEAD" && r.statusAllowsBody()
+}
+
+// DisableKeepAlive makes the response close the connection once it is done, for example because the server is shutting down.
+func (r *Response) DisableKeepAlive() {
+	r.keepAlive = false
+}
+
+// Hijack takes the connection over from the server. The returned ReadWriter reads whatever the client sent after the request, including
+// anything the server had already read ahead, and writes to the connection. Read and write deadlines are cleared, and from then on the handler
+// alone is responsible for the connection, closing it included.
+//
+// Anything the handler wrote before hijacking and that has not been sent yet is thrown away, so the handler speaks first on the bare connection.
+// Once the headers have been sent there is a response half way out and the connection can no longer be hijacked.
+func (r *Response) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if r.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if r.WritingState {
+		return nil, nil, errors.New("Can't hijack a connection after the headers have been sent")
+	}
+	var reader io.Reader = r.conn
+	if r.onHijack != nil {
+		reader = r.onHijack()
+	}
+	r.hijacked = true
+	r.keepAlive = false
+	r.Body = nil
+	r.conn.SetDeadline(time.Time{})
+	return r.conn, bufio.NewReadWriter(bufio.NewReader(reader), r.writer), nil
+}
+
+// Hijacked reports whether the handler has taken the connection over with Hijack.
+func (r *Response) Hijacked() bool {
+	return r.hijacked
+}
+
+// OnHijack registers the function Hijack calls before handing the connection over. The server uses it to stop reading the connection, and
+// returns from it what is left to read, read ahead bytes first.
+func (r *Response) OnHijack(fn func() io.Reader) {
+	r.onHijack = fn
+}
+
+// KeepAlive reports whether the connection can be reused for another request after this response.
+func (r *Response) KeepAlive() bool {
+	return r.keepAlive
+}
+
 
 // huge sidenote: I am taking the approach of using a struct that implements some of the methods of a the ResponseWriter interface. Some are decprecated, others are not. This may/will introduce bugs in more complex http server implementations.
 // If you are interestead in reading more about this, check this out: https://github.com/felixge/httpsnoop?tab=readme-ov-file#why-this-package-exists
-func NewResponseWriter(conn net.Conn) ResponseWriter {
+func NewResponseWriter(conn net.Conn, req *request.Request) *Response {
 	return &Response{
 		conn: conn,
+		writer: bufio.NewWriterSize(conn, bufferSize),
 		StatusLine: StatusLine{
 			Status: 200,
 			HttpVersion: "",
@@ -93,6 +364,19 @@ func NewResponseWriter(conn net.Conn) ResponseWriter {
 		},
 		Headers: headers.NewHeaders(),
 		WritingState: false,
+		declaredLength: -1,
+		httpVersion: req.RequestLine.HttpVersion,
+		method: req.RequestLine.Method,
+		keepAlive: req.KeepAlive(),
 	}
 }
 
+// SetCookie adds a Set-Cookie line for the cookie to the response. Every cookie gets a line of its own, since cookies can't be joined with commas
+// like other fields. An invalid cookie is not sent and its error is returned.
+func SetCookie(w ResponseWriter, c *cookie.Cookie) error {
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	w.GetHeaders().Add("Set-Cookie", c.String())
+	return nil
+}
@@ -1 +1,255 @@
 package response
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"github.com/juancruzfl/httpserver/internal/cookie"
+	"github.com/juancruzfl/httpserver/internal/headers"
+	"github.com/juancruzfl/httpserver/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bufferConn is a net.Conn that records everything written to it. Only Write is ever called by a Response in these tests.
+type bufferConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *bufferConn) Write(data []byte) (int, error) {
+	return c.written.Write(data)
+}
+
+func (c *bufferConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func newTestResponse(method string) (*Response, *bufferConn) {
+	conn := &bufferConn{}
+	req := request.NewMockRequest(request.NewMockRequestLine("1.1", "/", method), *headers.NewHeaders(), nil, 0)
+	return NewResponseWriter(conn, req), conn
+}
+
+func TestStatusText(t *testing.T) {
+	assert.Equal(t, "OK", StatusText(StatusOK))
+	assert.Equal(t, "Not Implemented", StatusText(501))
+	assert.Equal(t, "Internal Server Error", StatusText(500))
+	assert.Equal(t, "Content Too Large", StatusText(413))
+	assert.Equal(t, "Unprocessable Content", StatusText(422))
+	assert.Equal(t, "Request Header Fields Too Large", StatusText(431))
+	assert.Equal(t, "", StatusText(299))
+	assert.Equal(t, "", StatusText(418))
+}
+
+func TestStatusLinePhrases(t *testing.T) {
+	cases := map[int]string{
+		200: "HTTP/1.1 200 OK\r\n",
+		404: "HTTP/1.1 404 Not Found\r\n",
+		418: "HTTP/1.1 418 \r\n",
+		501: "HTTP/1.1 501 Not Implemented\r\n",
+		503: "HTTP/1.1 503 Service Unavailable\r\n",
+		999: "HTTP/1.1 999 \r\n",
+	}
+	for status, expected := range cases {
+		r, conn := newTestResponse("GET")
+		r.CustomWriteHeader(status)
+		r.Finish()
+		assert.True(t, strings.HasPrefix(conn.written.String(), expected), "status %d wrote %q", status, conn.written.String())
+		assert.Equal(t, status, r.StatusLine.Status)
+	}
+}
+
+func TestInvalidStatusPanics(t *testing.T) {
+	for _, status := range []int{0, 99, 1000, -200} {
+		r, _ := newTestResponse("GET")
+		assert.Panics(t, func() { r.CustomWriteHeader(status) }, "status %d", status)
+	}
+}
+
+func TestSmallBodyGetsContentLength(t *testing.T) {
+	r, conn := newTestResponse("GET")
+	r.Write([]byte("Hello, "))
+	r.Write([]byte("World!"))
+	assert.Empty(t, conn.written.String(), "nothing should be sent before the handler is done")
+
+	assert.NoError(t, r.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 13\r\n\r\nHello, World!", conn.written.String())
+	assert.True(t, r.KeepAlive())
+}
+
+func TestEmptyResponse(t *testing.T) {
+	r, conn := newTestResponse("GET")
+	assert.NoError(t, r.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", conn.written.String())
+}
+
+func TestLargeBodyIsChunked(t *testing.T) {
+	r, conn := newTestResponse("GET")
+	first := strings.Repeat("a", bufferSize)
+	r.Write([]byte(first))
+	r.Write([]byte("bb"))
+	r.Write([]byte("ccc"))
+	assert.NoError(t, r.Finish())
+
+	expected := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"1002\r\n" + first + "bb\r\n" +
+		"3\r\nccc\r\n" +
+		"0\r\n\r\n"
+	assert.Equal(t, expected, conn.written.String())
+	assert.True(t, r.KeepAlive())
+}
+
+func TestFlushSwitchesToChunked(t *testing.T) {
+	r, conn := newTestResponse("GET")
+	r.Write([]byte("event"))
+	assert.NoError(t, r.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nevent\r\n", conn.written.String())
+
+	r.Write([]byte(""))
+	r.Write([]byte("more"))
+	assert.NoError(t, r.Finish())
+	assert.True(t, strings.HasSuffix(conn.written.String(), "5\r\nevent\r\n4\r\nmore\r\n0\r\n\r\n"))
+}
+
+func TestDeclaredContentLengthIsNotChunked(t *testing.T) {
+	r, conn := newTestResponse("GET")
+	r.GetHeaders().Set("Content-Length", "5")
+	r.Write([]byte("hel"))
+	assert.NoError(t, r.Flush())
+	r.Write([]byte("lo"))
+	_, err := r.Write([]byte("!"))
+	assert.ErrorIs(t, err, ErrContentLength)
+	assert.NoError(t, r.Finish())
+
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", conn.written.String())
+	assert.True(t, r.KeepAlive())
+}
+
+func TestShortBodyClosesConnection(t *testing.T) {
+	r, _ := newTestResponse("GET")
+	r.GetHeaders().Set("Content-Length", "10")
+	r.Write([]byte("short"))
+	assert.NoError(t, r.Finish())
+	assert.False(t, r.KeepAlive())
+}
+
+func TestHTTP10StreamingClosesConnection(t *testing.T) {
+	conn := &bufferConn{}
+	req := request.NewMockRequest(request.NewMockRequestLine("1.0", "/", "GET"), *headers.NewHeaders(), nil, 0)
+	r := NewResponseWriter(conn, req)
+	r.Write([]byte("data"))
+	assert.NoError(t, r.Flush())
+	assert.NoError(t, r.Finish())
+
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\ndata", conn.written.String())
+	assert.False(t, r.KeepAlive())
+}
+
+func TestHeadResponseDropsBody(t *testing.T) {
+	r, conn := newTestResponse("HEAD")
+	n, err := r.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.NoError(t, r.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n", conn.written.String())
+}
+
+func TestHeadResponseWithoutLength(t *testing.T) {
+	r, conn := newTestResponse("HEAD")
+	r.Headers.Set("Content-Encoding", "gzip")
+	assert.NoError(t, r.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\n\r\n", conn.written.String())
+	assert.True(t, r.KeepAlive())
+}
+
+func TestNoContentHasNoFraming(t *testing.T) {
+	r, conn := newTestResponse("GET")
+	r.CustomWriteHeader(StatusNoContent)
+	_, err := r.Write([]byte("body"))
+	assert.Error(t, err)
+	assert.NoError(t, r.Finish())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", conn.written.String())
+	assert.True(t, r.KeepAlive())
+}
+
+func TestMaxBytesReader(t *testing.T) {
+	res, _ := newTestResponse("POST")
+	body := MaxBytesReader(res, io.NopCloser(strings.NewReader("0123456789")), 4)
+
+	data, err := io.ReadAll(body)
+	assert.Equal(t, "0123", string(data))
+	assert.ErrorIs(t, err, request.ErrBodyTooLarge)
+	assert.Equal(t, StatusContentTooLarge, res.StatusLine.Status)
+	assert.False(t, res.KeepAlive())
+
+	res, _ = newTestResponse("POST")
+	data, err = io.ReadAll(MaxBytesReader(res, io.NopCloser(strings.NewReader("0123")), 4))
+	require.NoError(t, err)
+	assert.Equal(t, "0123", string(data))
+	assert.Equal(t, 200, res.StatusLine.Status)
+}
+
+func TestRepeatedHeadersAreWrittenInOrder(t *testing.T) {
+	res, conn := newTestResponse("GET")
+	res.GetHeaders().Set("content-type", "text/plain")
+	res.GetHeaders().Add("Set-Cookie", "a=1; Path=/")
+	res.GetHeaders().Add("Set-Cookie", "b=2")
+	res.Write([]byte("ok"))
+	res.Finish()
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nSet-Cookie: a=1; Path=/\r\nSet-Cookie: b=2\r\nContent-Length: 2\r\n\r\nok", conn.written.String())
+}
+
+func TestHeaderInjectionIsDropped(t *testing.T) {
+	res, conn := newTestResponse("GET")
+	res.GetHeaders().Set("X-Echo", "hi\r\nSet-Cookie: session=stolen")
+	res.Write([]byte("ok"))
+	require.NoError(t, res.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", conn.written.String())
+}
+
+func TestSetCookie(t *testing.T) {
+	res, conn := newTestResponse("GET")
+	require.NoError(t, SetCookie(res, &cookie.Cookie{Name: "a", Value: "1", Path: "/", HttpOnly: true}))
+	require.NoError(t, SetCookie(res, &cookie.Cookie{Name: "b", Value: "2", SameSite: cookie.SameSiteLax}))
+	assert.ErrorIs(t, SetCookie(res, &cookie.Cookie{Name: "c", Value: "x\r\ny"}), cookie.ErrInvalidCookie)
+	require.NoError(t, res.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nSet-Cookie: a=1; Path=/; HttpOnly\r\nSet-Cookie: b=2; SameSite=Lax\r\nContent-Length: 0\r\n\r\n", conn.written.String())
+}
+
+func TestHijack(t *testing.T) {
+	r, conn := newTestResponse("GET")
+	r.OnHijack(func() io.Reader { return strings.NewReader("read ahead") })
+	r.GetHeaders().Set("X-Dropped", "yes")
+	r.Write([]byte("never sent"))
+
+	hijacked, rw, err := r.Hijack()
+	require.NoError(t, err)
+	assert.Same(t, conn, hijacked)
+	assert.True(t, r.Hijacked())
+	leftover, err := io.ReadAll(rw)
+	require.NoError(t, err)
+	assert.Equal(t, "read ahead", string(leftover))
+	rw.WriteString("raw bytes")
+	require.NoError(t, rw.Flush())
+
+	_, err = r.Write([]byte("more"))
+	assert.ErrorIs(t, err, ErrHijacked)
+	_, _, err = r.Hijack()
+	assert.ErrorIs(t, err, ErrHijacked)
+	require.NoError(t, r.Finish())
+	assert.Equal(t, "raw bytes", conn.written.String(), "nothing of the response goes out once the connection is hijacked")
+	assert.False(t, r.KeepAlive())
+}
+
+func TestHijackAfterHeadersFails(t *testing.T) {
+	r, _ := newTestResponse("GET")
+	r.Write([]byte("sent"))
+	require.NoError(t, r.Flush())
+	_, _, err := r.Hijack()
+	assert.Error(t, err)
+	assert.False(t, r.Hijacked())
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// aLongTimeAgo is a read deadline in the past, which makes a blocked Read return right away.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connReader sits between a connection and its RequestReader. Besides passing reads through, it can keep a read going in the background while
+// the handler runs, which is the only way to notice the client going away before we try writing to it.
+//
+// sidenote: a closed socket only shows up on the next read. Once the request body has been read, nothing reads the connection until the
+// handler is done, so a handler streaming events to a client that left would never find out. The background read asks for a single byte:
+// it comes back with an error when the client hangs up, and with the first byte of the next request when it pipelines one, which we hold on
+// to for the RequestReader.
+type connReader struct {
+	conn net.Conn
+	mu sync.Mutex
+	cond *sync.Cond
+	inRead bool
+	// aborted is set when we cut the background read short ourselves, so its timeout is not mistaken for the client going away
+	aborted bool
+	hasByte bool
+	byteBuf [1]byte
+	// cancel cancels the context of the request being handled
+	cancel context.CancelFunc
+}
+
+func newConnReader(conn net.Conn) *connReader {
+	cr := &connReader{conn: conn}
+	cr.cond = sync.NewCond(&cr.mu)
+	return cr
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	cr.mu.Lock()
+	if cr.inRead {
+		cr.mu.Unlock()
+		panic("Concurrent read on connection")
+	}
+	if len(p) == 0 {
+		cr.mu.Unlock()
+		return 0, nil
+	}
+	if cr.hasByte {
+		p[0] = cr.byteBuf[0]
+		cr.hasByte = false
+		cr.mu.Unlock()
+		return 1, nil
+	}
+	cr.inRead = true
+	cr.mu.Unlock()
+
+	n, err := cr.conn.Read(p)
+
+	cr.mu.Lock()
+	cr.inRead = false
+	if err != nil {
+		cr.cancelRequest()
+	}
+	cr.cond.Broadcast()
+	cr.mu.Unlock()
+	return n, err
+}
+
+// setCancel sets the function that cancels the context of the request being handled, nil once it has been answered.
+func (cr *connReader) setCancel(cancel context.CancelFunc) {
+	cr.mu.Lock()
+	cr.cancel = cancel
+	cr.mu.Unlock()
+}
+
+// cancelRequest must be called with mu held.
+func (cr *connReader) cancelRequest() {
+	if cr.cancel != nil {
+		cr.cancel()
+	}
+}
+
+// startBackgroundRead starts watching the connection while the handler runs. It must only be called once the request body has been read, and
+// the read deadline is lifted, since the client owes us nothing until the response is out.
+func (cr *connReader) startBackgroundRead() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.inRead || cr.hasByte {
+		return
+	}
+	cr.inRead = true
+	cr.conn.SetReadDeadline(time.Time{})
+	go cr.backgroundRead()
+}
+
+func (cr *connReader) backgroundRead() {
+	n, err := cr.conn.Read(cr.byteBuf[:])
+
+	cr.mu.Lock()
+	if n == 1 {
+		cr.hasByte = true
+	}
+	if err != nil && !(cr.aborted && errors.Is(err, os.ErrDeadlineExceeded)) {
+		cr.cancelRequest()
+	}
+	cr.aborted = false
+	cr.inRead = false
+	cr.cond.Broadcast()
+	cr.mu.Unlock()
+}
+
+// abortPendingRead stops the background read, if there is one, and waits for it to return.
+func (cr *connReader) abortPendingRead() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if !cr.inRead {
+		return
+	}
+	cr.aborted = true
+	cr.conn.SetReadDeadline(aLongTimeAgo)
+	for cr.inRead {
+		cr.cond.Wait()
+	}
+	cr.conn.SetReadDeadline(time.Time{})
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"github.com/juancruzfl/httpserver/internal/request"
+	"github.com/juancruzfl/httpserver/internal/response"
+	"github.com/juancruzfl/httpserver/internal/handler"
+)
+
+// sidenote: this is what is considered a 'router' in most http frameworks. In simple terms it helps the http server keep track of routes and their associated handlers
+type routeKey struct {
+	method string
+	path string
+}
+
+type route struct {
+	method string
+	pattern *pattern
+	handler handler.Handler
+}
+
+// sidenote: routes without wildcards are kept in a map, since they can only ever match their own path and a literal route always beats a
+// wildcard one matching the same path. Only when that lookup misses do we walk the list of wildcard routes looking for the most specific match.
+type MyServerMux struct {
+	routes map[routeKey]*route
+	patterns []*route
+	middleware []handler.Middleware
+}
+
+func NewServerMux() *MyServerMux {
+	return &MyServerMux{
+		routes: map[routeKey]*route{},
+	}
+}
+
+var MyDefaultMux = NewServerMux()
+
+// match finds the route for the method and path along with the wildcard values captured from the path.
+func (m *MyServerMux) match(method string, path string) (*route, map[string]string) {
+	if rt, ok := m.routes[routeKey{method: method, path: path}]; ok {
+		return rt, nil
+	}
+
+	var best *route
+	var bestValues map[string]string
+	for _, rt := range m.patterns {
+		if rt.method != method {
+			continue
+		}
+		values, ok := rt.pattern.match(path)
+		if !ok {
+			continue
+		}
+		if best == nil || rt.pattern.moreSpecific(best.pattern) {
+			best = rt
+			bestValues = values
+		}
+	}
+	return best, bestValues
+}
+
+func (m *MyServerMux) Get(method string, path string) (handler.Handler, bool) {
+	rt, _ := m.match(method, path)
+	if rt == nil {
+		return nil, false
+	}
+	return rt.handler, true
+}
+
+// allowedMethods lists, in sorted order, every method that has a route matching the path. HEAD is implied by GET and OPTIONS is always
+// answered by the mux itself, so they are added whenever the path is known at all.
+func (m *MyServerMux) allowedMethods(path string) []string {
+	found := map[string]bool{}
+	for key := range m.routes {
+		if key.path == path {
+			found[key.method] = true
+		}
+	}
+	for _, rt := range m.patterns {
+		if _, ok := rt.pattern.match(path); ok {
+			found[rt.method] = true
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	if found["GET"] {
+		found["HEAD"] = true
+	}
+	found["OPTIONS"] = true
+
+	methods := make([]string, 0, len(found))
+	for method := range found {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// sidenote: when nothing is registered for the method we still look at the path. If some other method would have matched, the client gets a
+// 405 along with the list of methods that would have worked, and OPTIONS requests are answered with that same list.
+func (m *MyServerMux) ServeHttp(w response.ResponseWriter, r *request.Request) {
+    if len(m.middleware) > 0 {
+        handler.Chain(handler.HandlerFunc(m.dispatch), m.middleware...).ServeHttp(w, r)
+        return
+    }
+    m.dispatch(w, r)
+}
+
+// Use adds middleware that wraps every request going through the mux, including the ones that end up as a 404 or 405.
+func (m *MyServerMux) Use(middleware ...handler.Middleware) {
+    m.middleware = append(m.middleware, middleware...)
+}
+
+func (m *MyServerMux) dispatch(w response.ResponseWriter, r *request.Request) {
+    method := r.RequestLine.Method
+    // routes match on the decoded and normalized path, the query string plays no part in routing
+    path := r.URL.Path
+
+    rt, values := m.match(method, path)
+    if rt == nil && method == "HEAD" {
+        // the response drops whatever body the GET handler writes
+        rt, values = m.match("GET", path)
+    }
+    if rt == nil {
+        allowed := m.allowedMethods(path)
+        if len(allowed) == 0 {
+            w.CustomWriteHeader(response.StatusNotFound)
+            w.Write([]byte("404 Not Found"))
+            return
+        }
+        w.GetHeaders().Set("Allow", strings.Join(allowed, ", "))
+        if method == "OPTIONS" {
+            w.CustomWriteHeader(response.StatusNoContent)
+            return
+        }
+        w.CustomWriteHeader(response.StatusMethodNotAllowed)
+        w.Write([]byte("405 Method Not Allowed"))
+        return
+    }
+    for name, value := range values {
+        r.SetPathValue(name, value)
+    }
+    rt.handler.ServeHttp(w, r)
+}
+
+// sidenote: we are casting the function that is being pass to the HandlerFunc method of the server multiplexer to the HandlerFunc apdater of the handler interface. It in turn, gives
+// us a valid handler, which is useful since we can reuse our Handle method.
+func (m *MyServerMux) HandleFunc(method string, path string, f func(response.ResponseWriter, *request.Request), middleware ...handler.Middleware) {
+    m.Handle(method, path, handler.HandlerFunc(f), middleware...)
+}
+
+// Handle registers the handler for the method and path. The path may contain named wildcards ("/users/{id}") and end in a catch-all
+// ("/static/{path...}"), whose values the handler reads with Request.PathValue. Registering the same method and pattern again replaces the
+// previous handler. Any middleware given only wraps this route. Handle panics if the path is not a valid pattern.
+func (m *MyServerMux) Handle(method string, path string, h handler.Handler, middleware ...handler.Middleware) {
+    p, err := parsePattern(path)
+    if err != nil {
+        panic(err)
+    }
+    if m.routes == nil {
+        m.routes = make(map[routeKey]*route)
+    }
+    rt := &route{method: method, pattern: p, handler: handler.Chain(h, middleware...)}
+
+    if p.isLiteral() {
+        m.routes[routeKey{method: method, path: path}] = rt
+        return
+    }
+    for i, existing := range m.patterns {
+        if existing.method == method && existing.pattern.sameShape(p) {
+            m.patterns[i] = rt
+            return
+        }
+    }
+    m.patterns = append(m.patterns, rt)
+}
+
+// RouteGroup registers routes on a mux under a shared path prefix, wrapping each of them with the group's middleware.
+type RouteGroup struct {
+	mux *MyServerMux
+	prefix string
+	middleware []handler.Middleware
+}
+
+// Group returns a group whose routes all live under prefix and go through the given middleware, e.g. mux.Group("/api", auth, logging).
+func (m *MyServerMux) Group(prefix string, middleware ...handler.Middleware) *RouteGroup {
+	return &RouteGroup{
+		mux: m,
+		prefix: strings.TrimSuffix(prefix, "/"),
+		middleware: middleware,
+	}
+}
+
+// Group returns a nested group. Its prefix is appended to this group's prefix and its middleware runs after this group's middleware.
+func (g *RouteGroup) Group(prefix string, middleware ...handler.Middleware) *RouteGroup {
+	return &RouteGroup{
+		mux: g.mux,
+		prefix: g.prefix + strings.TrimSuffix(prefix, "/"),
+		middleware: append(append([]handler.Middleware{}, g.middleware...), middleware...),
+	}
+}
+
+// Use adds middleware to the group. It only wraps routes registered on the group afterwards.
+func (g *RouteGroup) Use(middleware ...handler.Middleware) {
+	g.middleware = append(g.middleware, middleware...)
+}
+
+func (g *RouteGroup) Handle(method string, path string, h handler.Handler, middleware ...handler.Middleware) {
+	all := append(append([]handler.Middleware{}, g.middleware...), middleware...)
+	g.mux.Handle(method, g.prefix + path, h, all...)
+}
+
+func (g *RouteGroup) HandleFunc(method string, path string, f func(response.ResponseWriter, *request.Request), middleware ...handler.Middleware) {
+	g.Handle(method, path, handler.HandlerFunc(f), middleware...)
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"testing"
+	"testing/fstest"
+	"github.com/juancruzfl/httpserver/internal/handler"
+	"github.com/juancruzfl/httpserver/internal/headers"
+	"github.com/juancruzfl/httpserver/internal/request"
+	"github.com/juancruzfl/httpserver/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingWriter struct {
+	status int
+	headers *headers.Headers
+	body []byte
+}
+
+func newRecordingWriter() *recordingWriter {
+	return &recordingWriter{headers: headers.NewHeaders()}
+}
+
+func (w *recordingWriter) GetHeaders() *headers.Headers {
+	return w.headers
+}
+
+func (w *recordingWriter) CustomWriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	w.body = append(w.body, data...)
+	return len(data), nil
+}
+
+func newMuxRequest(method string, target string) *request.Request {
+	return request.NewMockRequest(request.NewMockRequestLine("1.1", target, method), *headers.NewHeaders(), nil, 0)
+}
+
+// nameHandler answers with its name followed by the path values it was asked to echo, so a test can tell which route won.
+func nameHandler(name string, wildcards ...string) func(response.ResponseWriter, *request.Request) {
+	return func(w response.ResponseWriter, r *request.Request) {
+		body := name
+		for _, wildcard := range wildcards {
+			body += " " + wildcard + "=" + r.PathValue(wildcard)
+		}
+		w.Write([]byte(body))
+	}
+}
+
+func serveMux(mux *MyServerMux, method string, target string) *recordingWriter {
+	w := newRecordingWriter()
+	mux.ServeHttp(w, newMuxRequest(method, target))
+	return w
+}
+
+func TestMuxNamedWildcard(t *testing.T) {
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/users/{id}", nameHandler("user", "id"))
+	mux.HandleFunc("GET", "/users/{id}/posts/{post}", nameHandler("post", "id", "post"))
+
+	assert.Equal(t, "user id=42", string(serveMux(mux, "GET", "/users/42").body))
+	assert.Equal(t, "post id=7 post=abc", string(serveMux(mux, "GET", "/users/7/posts/abc").body))
+	assert.Equal(t, 404, serveMux(mux, "GET", "/users/").status)
+	assert.Equal(t, 404, serveMux(mux, "GET", "/users/42/extra").status)
+	assert.Equal(t, 405, serveMux(mux, "POST", "/users/42").status)
+}
+
+func TestMuxCatchAll(t *testing.T) {
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/static/{path...}", nameHandler("static", "path"))
+
+	assert.Equal(t, "static path=css/site.css", string(serveMux(mux, "GET", "/static/css/site.css").body))
+	assert.Equal(t, "static path=", string(serveMux(mux, "GET", "/static/").body))
+	assert.Equal(t, 404, serveMux(mux, "GET", "/static").status)
+}
+
+func TestMuxPrecedence(t *testing.T) {
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/files/{path...}", nameHandler("catchall"))
+	mux.HandleFunc("GET", "/files/{name}", nameHandler("wildcard"))
+	mux.HandleFunc("GET", "/files/readme", nameHandler("literal"))
+	mux.HandleFunc("GET", "/files/{name}/raw", nameHandler("raw"))
+	mux.HandleFunc("GET", "/files/docs/{name}", nameHandler("docs"))
+
+	assert.Equal(t, "literal", string(serveMux(mux, "GET", "/files/readme").body))
+	assert.Equal(t, "wildcard", string(serveMux(mux, "GET", "/files/license").body))
+	assert.Equal(t, "raw", string(serveMux(mux, "GET", "/files/license/raw").body))
+	assert.Equal(t, "docs", string(serveMux(mux, "GET", "/files/docs/raw").body))
+	assert.Equal(t, "catchall", string(serveMux(mux, "GET", "/files/a/b/c").body))
+}
+
+func TestMuxReregisterReplaces(t *testing.T) {
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/users/{id}", nameHandler("first"))
+	mux.HandleFunc("GET", "/users/{name}", nameHandler("second", "name"))
+
+	assert.Equal(t, "second name=42", string(serveMux(mux, "GET", "/users/42").body))
+	handler, ok := mux.Get("GET", "/users/42")
+	require.True(t, ok)
+	assert.NotNil(t, handler)
+}
+
+func TestMuxInvalidPatternsPanic(t *testing.T) {
+	invalid := []string{"users", "/users/{id", "/users/id}", "/users/{}", "/files/{path...}/raw", "/a/{x}/{x}", "/a/{1x}", "/a/x{id}"}
+	for _, path := range invalid {
+		mux := NewServerMux()
+		assert.Panics(t, func() { mux.HandleFunc("GET", path, nameHandler("bad")) }, path)
+	}
+}
+
+func TestMuxMethodNotAllowed(t *testing.T) {
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/users/{id}", nameHandler("get"))
+	mux.HandleFunc("DELETE", "/users/{id}", nameHandler("delete"))
+	mux.HandleFunc("PUT", "/users/42", nameHandler("put"))
+
+	w := serveMux(mux, "POST", "/users/42")
+	assert.Equal(t, 405, w.status)
+	allow, ok := w.GetHeaders().Get("Allow")
+	require.True(t, ok)
+	assert.Equal(t, "DELETE, GET, HEAD, OPTIONS, PUT", allow)
+
+	w = serveMux(mux, "PUT", "/users/7")
+	assert.Equal(t, 405, w.status)
+	allow, _ = w.GetHeaders().Get("Allow")
+	assert.Equal(t, "DELETE, GET, HEAD, OPTIONS", allow)
+
+	w = serveMux(mux, "POST", "/unknown")
+	assert.Equal(t, 404, w.status)
+	_, ok = w.GetHeaders().Get("Allow")
+	assert.False(t, ok)
+}
+
+func TestMuxAutomaticOptions(t *testing.T) {
+	mux := NewServerMux()
+	mux.HandleFunc("POST", "/upload", nameHandler("upload"))
+
+	w := serveMux(mux, "OPTIONS", "/upload")
+	assert.Equal(t, 204, w.status)
+	allow, _ := w.GetHeaders().Get("Allow")
+	assert.Equal(t, "OPTIONS, POST", allow)
+	assert.Empty(t, w.body)
+
+	mux.HandleFunc("OPTIONS", "/upload", nameHandler("custom options"))
+	assert.Equal(t, "custom options", string(serveMux(mux, "OPTIONS", "/upload").body))
+}
+
+func TestMuxHeadUsesGetHandler(t *testing.T) {
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/hello", nameHandler("get"))
+
+	assert.Equal(t, 200, serveMux(mux, "HEAD", "/hello").status)
+
+	mux.HandleFunc("HEAD", "/hello", func(w response.ResponseWriter, r *request.Request) {
+		w.CustomWriteHeader(204)
+	})
+	assert.Equal(t, 204, serveMux(mux, "HEAD", "/hello").status)
+}
+
+func tagMiddleware(tag string) handler.Middleware {
+	return func(next handler.Handler) handler.Handler {
+		return handler.HandlerFunc(func(w response.ResponseWriter, r *request.Request) {
+			w.Write([]byte(tag + ">"))
+			next.ServeHttp(w, r)
+		})
+	}
+}
+
+func TestMuxGlobalMiddleware(t *testing.T) {
+	mux := NewServerMux()
+	mux.Use(tagMiddleware("global"))
+	mux.HandleFunc("GET", "/hello", nameHandler("hello"))
+
+	assert.Equal(t, "global>hello", string(serveMux(mux, "GET", "/hello").body))
+	assert.Equal(t, "global>404 Not Found", string(serveMux(mux, "GET", "/missing").body))
+}
+
+func TestMuxRouteMiddleware(t *testing.T) {
+	mux := NewServerMux()
+	mux.Use(tagMiddleware("global"))
+	mux.HandleFunc("GET", "/private", nameHandler("private"), tagMiddleware("auth"), tagMiddleware("log"))
+	mux.HandleFunc("GET", "/public", nameHandler("public"))
+
+	assert.Equal(t, "global>auth>log>private", string(serveMux(mux, "GET", "/private").body))
+	assert.Equal(t, "global>public", string(serveMux(mux, "GET", "/public").body))
+}
+
+func TestMuxGroups(t *testing.T) {
+	mux := NewServerMux()
+	api := mux.Group("/api/", tagMiddleware("api"))
+	api.HandleFunc("GET", "/status", nameHandler("status"))
+
+	v1 := api.Group("/v1", tagMiddleware("v1"))
+	v1.HandleFunc("GET", "/users/{id}", nameHandler("user", "id"), tagMiddleware("route"))
+	api.Use(tagMiddleware("late"))
+	api.HandleFunc("GET", "/late", nameHandler("late"))
+
+	assert.Equal(t, "api>status", string(serveMux(mux, "GET", "/api/status").body))
+	assert.Equal(t, "api>v1>route>user id=9", string(serveMux(mux, "GET", "/api/v1/users/9").body))
+	assert.Equal(t, "api>late>late", string(serveMux(mux, "GET", "/api/late").body))
+	assert.Equal(t, 404, serveMux(mux, "GET", "/status").status)
+}
+
+func TestMuxIgnoresQueryAndNormalizesPath(t *testing.T) {
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/search", func(w response.ResponseWriter, r *request.Request) {
+		w.Write([]byte("search " + r.Query().Get("q")))
+	})
+	mux.HandleFunc("GET", "/users/{name}", nameHandler("user", "name"))
+
+	assert.Equal(t, "search x y", string(serveMux(mux, "GET", "/search?q=x+y").body))
+	assert.Equal(t, "search ", string(serveMux(mux, "GET", "//search").body))
+	assert.Equal(t, "user name=josé", string(serveMux(mux, "GET", "/users/jos%C3%A9").body))
+	assert.Equal(t, "user name=ana", string(serveMux(mux, "GET", "/users/../users/ana?x=1").body))
+}
+
+func TestFileServerOnCatchAll(t *testing.T) {
+	mux := NewServerMux()
+	mux.Handle("GET", "/static/{path...}", handler.FileServer(fstest.MapFS{
+		"index.html": {Data: []byte("home")},
+		"css/site.css": {Data: []byte("body{}")},
+	}))
+
+	w := serveMux(mux, "GET", "/static/")
+	assert.Equal(t, 200, w.status)
+	assert.Equal(t, "home", string(w.body))
+	w = serveMux(mux, "GET", "/static/css/site.css")
+	assert.Equal(t, "body{}", string(w.body))
+	assert.Equal(t, 404, serveMux(mux, "GET", "/static/%2e%2e/mux.go").status)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sidenote: a pattern is a route path that has been split into its segments. A segment is either a literal ("users"), a named wildcard ("{id}")
+// that matches exactly one segment, or a trailing catch-all ("{path...}") that matches everything that is left, slashes included.
+type segmentKind int
+const (
+	segmentLiteral segmentKind = 0
+	segmentWildcard segmentKind = 1
+	segmentCatchAll segmentKind = 2
+)
+
+type segment struct {
+	kind segmentKind
+	// value is the literal text for literal segments and the wildcard name otherwise.
+	value string
+}
+
+type pattern struct {
+	raw string
+	segments []segment
+}
+
+// parsePattern validates a route path and splits it into segments. Routes are registered by the program itself, so an invalid one is a
+// programming error and Handle panics with the error returned here.
+func parsePattern(raw string) (*pattern, error) {
+	if !strings.HasPrefix(raw, "/") {
+		return nil, fmt.Errorf("Invalid pattern %q: must start with a '/'", raw)
+	}
+
+	parts := strings.Split(raw[1:], "/")
+	p := &pattern{raw: raw}
+	names := map[string]bool{}
+	for i, part := range parts {
+		if !strings.ContainsAny(part, "{}") {
+			p.segments = append(p.segments, segment{kind: segmentLiteral, value: part})
+			continue
+		}
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			return nil, fmt.Errorf("Invalid pattern %q: a wildcard must be a whole segment", raw)
+		}
+
+		name := part[1 : len(part)-1]
+		kind := segmentWildcard
+		if catchAll, found := strings.CutSuffix(name, "..."); found {
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("Invalid pattern %q: {%s} must be the last segment", raw, name)
+			}
+			name = catchAll
+			kind = segmentCatchAll
+		}
+		if !isWildcardName(name) {
+			return nil, fmt.Errorf("Invalid pattern %q: bad wildcard name %q", raw, name)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("Invalid pattern %q: duplicate wildcard name %q", raw, name)
+		}
+		names[name] = true
+		p.segments = append(p.segments, segment{kind: kind, value: name})
+	}
+	return p, nil
+}
+
+func isWildcardName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		char := name[i]
+		if (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || char == '_' || (i > 0 && char >= '0' && char <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// isLiteral reports whether the pattern has no wildcards, in which case it only ever matches the path it was written as.
+func (p *pattern) isLiteral() bool {
+	for _, seg := range p.segments {
+		if seg.kind != segmentLiteral {
+			return false
+		}
+	}
+	return true
+}
+
+// match checks the path against the pattern and returns the wildcard values it captured. A named wildcard never matches an empty segment, while a
+// catch-all may be empty ("/static/" matches "/static/{path...}" with path set to "").
+func (p *pattern) match(path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	parts := strings.Split(path[1:], "/")
+
+	var values map[string]string
+	for i, seg := range p.segments {
+		if i >= len(parts) {
+			return nil, false
+		}
+		switch seg.kind {
+		case segmentLiteral:
+			if parts[i] != seg.value {
+				return nil, false
+			}
+		case segmentWildcard:
+			if parts[i] == "" {
+				return nil, false
+			}
+			if values == nil {
+				values = map[string]string{}
+			}
+			values[seg.value] = parts[i]
+		case segmentCatchAll:
+			if values == nil {
+				values = map[string]string{}
+			}
+			values[seg.value] = strings.Join(parts[i:], "/")
+			return values, true
+		}
+	}
+	if len(parts) != len(p.segments) {
+		return nil, false
+	}
+	return values, true
+}
+
+// moreSpecific reports whether p should win over other when both match the same path. Going segment by segment, the first position where
+// the two differ decides: a literal beats a named wildcard, which beats a catch-all. With the same shape all the way, the longer pattern wins.
+func (p *pattern) moreSpecific(other *pattern) bool {
+	for i := 0; i < len(p.segments) && i < len(other.segments); i++ {
+		if p.segments[i].kind != other.segments[i].kind {
+			return p.segments[i].kind < other.segments[i].kind
+		}
+	}
+	return len(p.segments) > len(other.segments)
+}
+
+// sameShape reports whether both patterns match exactly the same set of paths, e.g. "/users/{id}" and "/users/{name}".
+func (p *pattern) sameShape(other *pattern) bool {
+	if len(p.segments) != len(other.segments) {
+		return false
+	}
+	for i := range p.segments {
+		if p.segments[i].kind != other.segments[i].kind {
+			return false
+		}
+		if p.segments[i].kind == segmentLiteral && p.segments[i].value != other.segments[i].value {
+			return false
+		}
+	}
+	return true
+}
@@ -1,98 +1,455 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/juancruzfl/httpserver/internal/headers"
 	"github.com/juancruzfl/httpserver/internal/request"
 	"github.com/juancruzfl/httpserver/internal/response"
 	"github.com/juancruzfl/httpserver/internal/handler"
 )
 
-// sidenote: this is what is considered a 'router' in most http frameworks. In simple terms it helps the http server keep track of routes and their associated handlers
-type routeKey struct {
-	method string
-	path string
+// ErrServerClosed is returned by Serve and ListenAndServe once Shutdown or Close has been called.
+var ErrServerClosed = errors.New("Server closed")
+
+// sidenote: a connection that sits idle between requests is closed after this long so that we don't hold on to a goroutine and a socket forever.
+const defaultIdleTimeout = 2 * time.Minute
+
+// maxDiscardBytes is how much of a body left unread by the handler we are willing to read and throw away to keep the connection alive. Past
+// that it is cheaper to close the connection than to keep reading.
+const maxDiscardBytes = 256 << 10
+
+// this is how often Shutdown checks whether the in-flight connections have finished.
+const shutdownPollInterval = 50 * time.Millisecond
+
+type connState int
+const (
+	stateIdle connState = 0
+	stateActive connState = 1
+)
+
+// Server holds the configuration of an http server along with the bookkeeping it needs to stop. The zero value is ready to use: it listens on ":8000"
+// and dispatches requests to MyDefaultMux.
+type Server struct {
+	Addr string
+	Handler handler.Handler
+	// ReadHeaderTimeout is how long a client has to send the request line and headers once the first byte of a request has arrived.
+	// Zero means ReadTimeout is used instead.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout is how long a client has to send an entire request, body included. Zero means no limit.
+	ReadTimeout time.Duration
+	// WriteTimeout is how long the handler and the response have, counted from the end of the request headers. Zero means no limit.
+	WriteTimeout time.Duration
+	// IdleTimeout is how long a keep-alive connection may wait for its next request. Zero means ReadTimeout is used, or defaultIdleTimeout when both are zero.
+	IdleTimeout time.Duration
+	// MaxBodyBytes is the largest request body a handler may read. A handler reading past it gets an error, and the client a 413 with the
+	// connection closed.
+	// Zero means no limit. Routes can raise or lower it with handler.MaxBodyBytes.
+	MaxBodyBytes int64
+	// MaxHeaderBytes caps the size of the request line and headers, and MaxHeaderCount the number of header lines. A request going over either
+	// is answered with a 431. Zero means request.DefaultMaxHeaderBytes and request.DefaultMaxHeaderCount.
+	MaxHeaderBytes int
+	MaxHeaderCount int
+	// ObsFold decides what happens to header values folded over several lines. The zero value, headers.FoldReject, answers them with a 400.
+	ObsFold headers.FoldPolicy
+	// TLSConfig is used by ListenAndServeTLS and ServeTLS. It is cloned, so changing it after the server started has no effect.
+	TLSConfig *tls.Config
+	// ErrorLog receives connection errors on the side of the server and the stack traces of handlers that panicked. Malformed requests are answered
+	// but not logged. Nil means the standard logger of the log package.
+	ErrorLog *log.Logger
+
+	mu sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns map[net.Conn]connState
+	inShutdown atomic.Bool
 }
 
-type MyServerMux struct {
-	routes map[routeKey]handler.Handler
+func (s *Server) ListenAndServe() error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	addr := s.Addr
+	if addr == "" {
+		addr = ":8000"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
 }
 
-func NewServerMux() *MyServerMux {
-	return &MyServerMux{
-		routes: map[routeKey]handler.Handler{},
+// Serve accepts connections on the listener and serves each of them on its own goroutine. It always returns a non-nil error; after Shutdown or Close
+// that error is ErrServerClosed.
+func (s *Server) Serve(listener net.Listener) error {
+	if !s.trackListener(listener, true) {
+		listener.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(listener, false)
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.trackConn(conn, true) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		// sidenote: I have decided to change how the request is read here. If we read the incoming requests and then wait for them to be parsed, we disallow multiple people from
+		// connecting to our server since we are occupaying the main thread in our method to wait for the request operations to finsih. We instead use a go rountine in a serve function
+		// to offshore that work into a background thread.
+		go func(c net.Conn) {
+			defer s.trackConn(c, false)
+			err := s.serve(c)
+			// a connection torn down by Close or Shutdown fails with whatever it was doing at the time, which is not worth reporting
+			if err != nil && !(errors.Is(err, net.ErrClosed) && s.shuttingDown()) {
+				s.logf("Error in trying to serve connection %s: %v", c.RemoteAddr(), err)
+			}
+		}(conn)
 	}
 }
 
-var MyDefaultMux = NewServerMux()
+// Shutdown stops the server without interrupting requests that are being handled. It closes the listeners, closes connections that are idle and
+// then waits for the active ones to finish their current response. If the context expires first, its error is returned and the remaining connections are left running.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
 
-func (m *MyServerMux) Get(method string, path string) (handler.Handler, bool) {
-	key := routeKey{method: method, path: path}
-	handler, ok := m.routes[key]
-	return handler, ok			
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
 }
 
-func (m *MyServerMux) ServeHttp(w response.ResponseWriter, r *request.Request) {
-    key := routeKey{
-        method: r.RequestLine.Method,
-        path:   r.RequestLine.RequestTarget,
-    }
-    handler, ok := m.routes[key]
-    if !ok {
-        w.CustomWriteHeader(404)
-        w.Write([]byte("404 Not Found"))
-        return
-    }
-    handler.ServeHttp(w, r)
+// Close stops the server immediately, closing the listeners and every connection whether it is in the middle of a request or not.
+func (s *Server) Close() error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.closeListenersLocked()
+	for c := range s.conns {
+		c.Close()
+		delete(s.conns, c)
+	}
+	return err
 }
 
-// sidenote: we are casting the function that is being pass to the HandlerFunc method of the server multiplexer to the HandlerFunc apdater of the handler interface. It in turn, gives
-// us a valid handler, which is useful since we can reuse our Handle method.
-func (m *MyServerMux) HandleFunc(method string, path string, f func(response.ResponseWriter, *request.Request)) {
-    m.Handle(method, path, handler.HandlerFunc(f))
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
 }
 
-func (m *MyServerMux) Handle(method string, path string, h handler.Handler) {
-    if m.routes == nil {
-        m.routes = make(map[routeKey]handler.Handler)
-    }
-    key := routeKey{method: method, path: path}
-    m.routes[key] = h
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, l)
+	}
+	return err
 }
 
-func serve(conn net.Conn, h handler.Handler) error {
-	defer conn.Close()
+// closeIdleConns closes every connection that is waiting for a request and reports whether no connections are left at all.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	quiescent := true
+	for c, state := range s.conns {
+		if state != stateIdle {
+			quiescent = false
+			continue
+		}
+		c.Close()
+		delete(s.conns, c)
+	}
+	return quiescent
+}
 
-	request, err := request.RequestFromReader(conn)
-	if err != nil {
-		return err
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		if s.listeners == nil {
+			s.listeners = make(map[net.Listener]struct{})
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
 	}
-	if h == nil {
-		h = MyDefaultMux
+	return true
+}
+
+func (s *Server) trackConn(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		if s.conns == nil {
+			s.conns = make(map[net.Conn]connState)
+		}
+		s.conns[c] = stateIdle
+	} else {
+		delete(s.conns, c)
 	}
-	writer := response.NewResponseWriter(conn)
-	h.ServeHttp(writer, request)
-	return nil 
+	return true
 }
 
-func CustomListenAndServe(addr string, h handler.Handler) error {
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+// setState records whether a connection is idle or active. It reports false when the server is shutting down and has already let go of the connection.
+func (s *Server) setState(c net.Conn, state connState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[c]; !ok {
+		return !s.shuttingDown()
 	}
-	defer listener.Close()
+	s.conns[c] = state
+	return true
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	if s.ReadTimeout > 0 {
+		return s.ReadTimeout
+	}
+	return defaultIdleTimeout
+}
+
+func (s *Server) readHeaderTimeout() time.Duration {
+	if s.ReadHeaderTimeout > 0 {
+		return s.ReadHeaderTimeout
+	}
+	return s.ReadTimeout
+}
+
+// deadline turns a timeout into an absolute deadline. A zero timeout gives the zero time, which net.Conn treats as no deadline at all.
+func deadline(start time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(timeout)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// sendStatus writes a complete response with a short plain text body straight to the connection. It is used for the cases where the server has
+// to answer on its own because no handler got to see the request, and it always asks the client to close the connection.
+func sendStatus(conn net.Conn, status int) {
+	phrase := response.StatusText(status)
+	body := fmt.Sprintf("%d %s", status, phrase)
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\n\r\n%s", status, phrase, len(body), body)
+}
+
+// statusForParseError maps the errors of the request parser to the status the client should get. It reports false for errors that don't
+// come from the parser (the connection broke or the client went away), where there is nobody left to answer.
+func statusForParseError(err error) (int, bool) {
+	switch {
+	case errors.Is(err, request.ErrHeaderTooLarge):
+		return response.StatusRequestHeaderFieldsTooLarge, true
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		return response.StatusHTTPVersionNotSupported, true
+	case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		return response.StatusNotImplemented, true
+	case errors.Is(err, request.ErrMalformedRequestLine), errors.Is(err, request.ErrMalformedHeader), errors.Is(err, request.ErrMalformedBody):
+		return response.StatusBadRequest, true
+	}
+	return 0, false
+}
+
+// serve runs the request loop of a single connection. HTTP/1.1 connections are persistent by default, so we keep reading requests off the
+// same socket until either side asks for it to be closed, the client goes quiet or the server is shutting down.
+func (s *Server) serve(conn net.Conn) error {
+	hijacked := false
+	defer func() {
+		if !hijacked {
+			conn.Close()
+		}
+	}()
+
+	h := s.Handler
+	if h == nil {
+		h = MyDefaultMux
+	}
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state, err := s.handshake(tlsConn)
+		if state == nil {
+			return err
+		}
+		tlsState = state
+	}
+
+	cr := newConnReader(conn)
+	reader := request.NewRequestReader(cr)
+	reader.MaxHeaderBytes = s.MaxHeaderBytes
+	reader.MaxHeaderCount = s.MaxHeaderCount
+	reader.ObsFold = s.ObsFold
 	for {
-		conn, err := listener.Accept()
+		s.setState(conn, stateIdle)
+		if s.shuttingDown() {
+			return nil
+		}
+		conn.SetReadDeadline(time.Now().Add(s.idleTimeout()))
+		if err := reader.Ready(); err != nil {
+			// the client went away, the connection went idle for too long or Shutdown closed it. None of those are errors worth reporting.
+			return nil
+		}
+		if !s.setState(conn, stateActive) {
+			return nil
+		}
+
+		// sidenote: the deadlines are what protect us from slowloris style clients. Without them a client can send half of a request line and hold
+		// on to this goroutine forever. The header deadline is swapped for the (usually longer) whole request deadline once the headers are in,
+		// which keeps applying while the handler streams the body.
+		start := time.Now()
+		conn.SetReadDeadline(deadline(start, s.readHeaderTimeout()))
+
+		request, err := reader.ReadRequest()
 		if err != nil {
+			if isTimeout(err) {
+				sendStatus(conn, response.StatusRequestTimeout)
+				return nil
+			}
+			// sidenote: a malformed request is the client's problem and has been answered as such. Logging it would hand anyone able to
+			// open a connection a way to flood the log, so only errors on our side get that far.
+			if status, ok := statusForParseError(err); ok {
+				sendStatus(conn, status)
+				return nil
+			}
 			return err
 		}
-		// sidenote: I have decided to change how the request is read here. If we read the incoming requests and then wait for them to be parsed, we disallow multiple people from
-		// connecting to our server since we are occupaying the main thread in our method to wait for the request operations to finsih. We instead use a go rountine in a serve function
-		// to offshore that work into a background thread.
-		go func(c net.Conn) {
-			err := serve(c, h)
-			if err != nil {
-				println("Error in trying to serve connection", err.Error())
+		conn.SetReadDeadline(deadline(start, s.ReadTimeout))
+		conn.SetWriteDeadline(deadline(time.Now(), s.WriteTimeout))
+
+		request.TLS = tlsState
+		writer := response.NewResponseWriter(conn, request)
+		if s.shuttingDown() {
+			writer.DisableKeepAlive()
+		}
+		request.SetBodyLimit(s.MaxBodyBytes)
+		request.OnBodyLimit(func() {
+			writer.CustomWriteHeader(response.StatusContentTooLarge)
+			writer.DisableKeepAlive()
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		request.SetContext(ctx)
+		cr.setCancel(cancel)
+		// the connection can only be watched once the body is out of the way, and not at all while a pipelined request sits in the buffer
+		request.OnBodyDone(func() {
+			if reader.Buffered() == 0 {
+				cr.startBackgroundRead()
 			}
-		}(conn)
+		})
+		writer.OnHijack(func() io.Reader {
+			request.OnBodyDone(nil)
+			cr.abortPendingRead()
+			cr.setCancel(nil)
+			// sidenote: a hijacked connection belongs to the handler, so Shutdown no longer waits for it and Close no longer closes it
+			s.trackConn(conn, false)
+			return reader.Detach()
+		})
+		panicked := s.runHandler(h, writer, request)
+		request.OnBodyDone(nil)
+		cr.abortPendingRead()
+		cr.setCancel(nil)
+		cancel()
+		if writer.Hijacked() {
+			// a handler that panicked can't have left the connection in any state worth keeping
+			hijacked = !panicked
+			return nil
+		}
+		request.RemoveMultipartFiles()
+		if panicked {
+			// sidenote: once the headers are out there is no way to tell the client something went wrong, and finishing the response normally
+			// (a last chunk, say) would pass a half written body off as complete. Closing the connection is the only honest answer left.
+			if writer.WritingState {
+				return nil
+			}
+			writer = response.NewResponseWriter(conn, request)
+			writer.DisableKeepAlive()
+			writer.CustomWriteHeader(response.StatusInternalServerError)
+			writer.GetHeaders().Set("Content-Type", "text/plain; charset=utf-8")
+			writer.Write([]byte("500 Internal Server Error"))
+		}
+		if err := writer.Finish(); err != nil {
+			return err
+		}
+		if !writer.KeepAlive() {
+			return nil
+		}
+		// whatever the handler did not read of the body is still sitting on the connection in front of the next request
+		if !request.DiscardBody(maxDiscardBytes) {
+			return nil
+		}
+	}
+}
+
+// ErrAbortHandler can be used as a panic value to abort a handler on purpose. The connection is dropped like for any other panic, but no stack
+// trace is logged.
+var ErrAbortHandler = errors.New("Abort handler")
+
+// runHandler calls the handler and recovers from a panic in it, so a bug in a single handler only costs its own connection instead of the whole
+// process. It reports whether the handler panicked.
+func (s *Server) runHandler(h handler.Handler, w *response.Response, r *request.Request) (panicked bool) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			panicked = true
+			if recovered != ErrAbortHandler {
+				s.logf("Panic serving %s %s: %v\n%s", r.RequestLine.Method, r.RequestLine.RequestTarget, recovered, debug.Stack())
+			}
+		}
+	}()
+	h.ServeHttp(w, r)
+	return false
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+		return
 	}
+	log.Printf(format, args...)
+}
+
+// CustomListenAndServe listens on addr and serves connections with the handler h, or MyDefaultMux when h is nil. It is kept as a shortcut for
+// a Server that is never shut down.
+func CustomListenAndServe(addr string, h handler.Handler) error {
+	server := &Server{Addr: addr, Handler: h}
+	return server.ListenAndServe()
 }
@@ -1 +1,759 @@
 package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"github.com/juancruzfl/httpserver/internal/handler"
+	"github.com/juancruzfl/httpserver/internal/headers"
+	"github.com/juancruzfl/httpserver/internal/request"
+	"github.com/juancruzfl/httpserver/internal/response"
+	"github.com/juancruzfl/httpserver/internal/sse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMux() *MyServerMux {
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/hello", func(w response.ResponseWriter, r *request.Request) {
+		w.GetHeaders().Set("Content-Length", "5")
+		w.Write([]byte("hello"))
+	})
+	return mux
+}
+
+// serveTestConn hands one end of an in-memory connection to serve and returns the other end to the test acting as the client.
+func serveTestConn(t *testing.T, mux *MyServerMux) net.Conn {
+	return serveTestConnWith(t, &Server{Handler: mux})
+}
+
+func serveTestConnWith(t *testing.T, server *Server) net.Conn {
+	client, srv := net.Pipe()
+	go server.serve(srv)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func readResponse(t *testing.T, reader *bufio.Reader) (string, string) {
+	var head strings.Builder
+	contentLength := -1
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+		if strings.HasPrefix(strings.ToLower(line), "content-length:") {
+			length, err := strconv.Atoi(strings.TrimSpace(line[len("content-length:"):]))
+			require.NoError(t, err)
+			contentLength = length
+		}
+	}
+	if contentLength == -1 {
+		body, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		return head.String(), string(body)
+	}
+	body := make([]byte, contentLength)
+	_, err := io.ReadFull(reader, body)
+	require.NoError(t, err)
+	return head.String(), string(body)
+}
+
+func TestKeepAliveServesPipelinedRequests(t *testing.T) {
+	client := serveTestConn(t, newTestMux())
+	go client.Write([]byte("GET /hello HTTP/1.1\r\nHost: localhost\r\n\r\nGET /hello HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	reader := bufio.NewReader(client)
+	for i := 0; i < 2; i++ {
+		head, body := readResponse(t, reader)
+		assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"))
+		assert.NotContains(t, strings.ToLower(head), "connection: close")
+		assert.Equal(t, "hello", body)
+	}
+}
+
+func TestConnectionCloseEndsLoop(t *testing.T) {
+	client := serveTestConn(t, newTestMux())
+	go client.Write([]byte("GET /hello HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+
+	reader := bufio.NewReader(client)
+	head, body := readResponse(t, reader)
+	assert.Contains(t, strings.ToLower(head), "connection: close")
+	assert.Equal(t, "hello", body)
+
+	_, err := reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestHTTP10ClosesByDefault(t *testing.T) {
+	client := serveTestConn(t, newTestMux())
+	go client.Write([]byte("GET /hello HTTP/1.0\r\nHost: localhost\r\n\r\n"))
+
+	reader := bufio.NewReader(client)
+	head, _ := readResponse(t, reader)
+	assert.Contains(t, strings.ToLower(head), "connection: close")
+
+	_, err := reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestHTTP10KeepAlive(t *testing.T) {
+	client := serveTestConn(t, newTestMux())
+	go client.Write([]byte("GET /hello HTTP/1.0\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\nGET /hello HTTP/1.0\r\nHost: localhost\r\n\r\n"))
+
+	reader := bufio.NewReader(client)
+	head, body := readResponse(t, reader)
+	assert.Contains(t, strings.ToLower(head), "connection: keep-alive")
+	assert.Equal(t, "hello", body)
+
+	head, body = readResponse(t, reader)
+	assert.Contains(t, strings.ToLower(head), "connection: close")
+	assert.Equal(t, "hello", body)
+}
+
+func TestUnframedResponseGetsContentLength(t *testing.T) {
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/", func(w response.ResponseWriter, r *request.Request) {
+		w.Write([]byte("no length"))
+	})
+	client := serveTestConn(t, mux)
+	go client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	reader := bufio.NewReader(client)
+	for i := 0; i < 2; i++ {
+		head, body := readResponse(t, reader)
+		assert.Contains(t, strings.ToLower(head), "content-length: 9")
+		assert.NotContains(t, strings.ToLower(head), "connection: close")
+		assert.Equal(t, "no length", body)
+	}
+}
+
+func startTestServer(t *testing.T, mux *MyServerMux) (*Server, string, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &Server{Handler: mux}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.Serve(listener)
+	}()
+	t.Cleanup(func() { server.Close() })
+	return server, listener.Addr().String(), errChan
+}
+
+func TestShutdownWaitsForActiveRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/slow", func(w response.ResponseWriter, r *request.Request) {
+		close(started)
+		<-release
+		w.GetHeaders().Set("Content-Length", "4")
+		w.Write([]byte("done"))
+	})
+	server, addr, errChan := startTestServer(t, mux)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- server.Shutdown(context.Background())
+	}()
+
+	require.ErrorIs(t, <-errChan, ErrServerClosed)
+	select {
+	case <-shutdownErr:
+		t.Fatal("Shutdown returned while a handler was still running")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	_, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "done", body)
+	assert.NoError(t, <-shutdownErr)
+}
+
+func TestShutdownClosesIdleConnections(t *testing.T) {
+	server, addr, errChan := startTestServer(t, newTestMux())
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /hello HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	_, body := readResponse(t, reader)
+	assert.Equal(t, "hello", body)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, server.Shutdown(ctx))
+	require.ErrorIs(t, <-errChan, ErrServerClosed)
+
+	_, err = reader.ReadByte()
+	assert.Error(t, err)
+}
+
+func TestShutdownContextExpires(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/stuck", func(w response.ResponseWriter, r *request.Request) {
+		close(started)
+		<-release
+	})
+	server, addr, _ := startTestServer(t, mux)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /stuck HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+}
+
+func TestServeAfterCloseReturnsErrServerClosed(t *testing.T) {
+	server := &Server{}
+	require.NoError(t, server.Close())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	assert.ErrorIs(t, server.Serve(listener), ErrServerClosed)
+	assert.ErrorIs(t, server.ListenAndServe(), ErrServerClosed)
+}
+
+func TestReadHeaderTimeoutSends408(t *testing.T) {
+	client := serveTestConnWith(t, &Server{Handler: newTestMux(), ReadHeaderTimeout: 50 * time.Millisecond})
+	_, err := client.Write([]byte("GET /hello HT"))
+	require.NoError(t, err)
+
+	head, _ := readResponse(t, bufio.NewReader(client))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 408 Request Timeout\r\n"))
+}
+
+func TestIdleTimeoutClosesConnection(t *testing.T) {
+	client := serveTestConnWith(t, &Server{Handler: newTestMux(), IdleTimeout: 50 * time.Millisecond})
+	go client.Write([]byte("GET /hello HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	reader := bufio.NewReader(client)
+	_, body := readResponse(t, reader)
+	assert.Equal(t, "hello", body)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReadTimeoutCoversBody(t *testing.T) {
+	bodyErr := make(chan error, 1)
+	mux := NewServerMux()
+	mux.HandleFunc("POST", "/upload", func(w response.ResponseWriter, r *request.Request) {
+		_, err := io.ReadAll(r.BodyReader)
+		bodyErr <- err
+	})
+	client := serveTestConnWith(t, &Server{Handler: mux, ReadHeaderTimeout: time.Second, ReadTimeout: 50 * time.Millisecond})
+	_, err := client.Write([]byte("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc"))
+	require.NoError(t, err)
+
+	assert.True(t, isTimeout(<-bodyErr))
+}
+
+func TestUnreadBodyIsDiscarded(t *testing.T) {
+	mux := NewServerMux()
+	mux.HandleFunc("POST", "/ignore", func(w response.ResponseWriter, r *request.Request) {
+		w.Write([]byte("ignored"))
+	})
+	mux.HandleFunc("POST", "/partial", func(w response.ResponseWriter, r *request.Request) {
+		buffer := make([]byte, 2)
+		r.BodyReader.Read(buffer)
+		r.BodyReader.Close()
+		w.Write(buffer)
+	})
+	client := serveTestConn(t, mux)
+	go client.Write([]byte("POST /ignore HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nbody" +
+		"POST /partial HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nbody\r\n0\r\n\r\n" +
+		"GET /hello HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	reader := bufio.NewReader(client)
+	_, body := readResponse(t, reader)
+	assert.Equal(t, "ignored", body)
+	_, body = readResponse(t, reader)
+	assert.Equal(t, "bo", body)
+	head, _ := readResponse(t, reader)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 404"))
+}
+
+func TestLargeUnreadBodyClosesConnection(t *testing.T) {
+	mux := NewServerMux()
+	mux.HandleFunc("POST", "/ignore", func(w response.ResponseWriter, r *request.Request) {
+		w.Write([]byte("ignored"))
+	})
+	client := serveTestConn(t, mux)
+	go func() {
+		client.Write([]byte("POST /ignore HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10000000\r\n\r\n"))
+		client.Write([]byte(strings.Repeat("z", maxDiscardBytes + 1)))
+	}()
+
+	reader := bufio.NewReader(client)
+	_, body := readResponse(t, reader)
+	assert.Equal(t, "ignored", body)
+	_, err := reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestWriteTimeout(t *testing.T) {
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/", func(w response.ResponseWriter, r *request.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("too late"))
+	})
+	client := serveTestConnWith(t, &Server{Handler: mux, WriteTimeout: 50 * time.Millisecond})
+	_, err := client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = bufio.NewReader(client).ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestParseErrorsGetAResponse(t *testing.T) {
+	cases := []struct {
+		data     string
+		expected string
+	}{
+		{"GET /\r\n\r\n", "HTTP/1.1 400 Bad Request\r\n"},
+		{"GET / HTTP/1.1\r\nBad Header\r\n\r\n", "HTTP/1.1 400 Bad Request\r\n"},
+		{"GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", request.DefaultMaxHeaderBytes) + "\r\n\r\n", "HTTP/1.1 431 Request Header Fields Too Large\r\n"},
+		{"GET / HTTP/3.0\r\n\r\n", "HTTP/1.1 505 HTTP Version Not Supported\r\n"},
+		{"POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: br\r\n\r\n", "HTTP/1.1 501 Not Implemented\r\n"},
+	}
+	for _, c := range cases {
+		client := serveTestConn(t, newTestMux())
+		go client.Write([]byte(c.data))
+
+		head, _ := readResponse(t, bufio.NewReader(client))
+		assert.True(t, strings.HasPrefix(head, c.expected), "request %q got %q", c.data, head)
+		assert.Contains(t, head, "Connection: close")
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	server := &Server{Handler: newTestMux(), MaxHeaderBytes: 1024, MaxHeaderCount: 3}
+
+	client := serveTestConnWith(t, server)
+	go client.Write([]byte("GET /hello HTTP/1.1\r\nHost: localhost\r\nX-Long: " + strings.Repeat("a", 1500) + "\r\n\r\n"))
+	head, _ := readResponse(t, bufio.NewReader(client))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 431 "), head)
+
+	client = serveTestConnWith(t, server)
+	go client.Write([]byte("GET /hello HTTP/1.1\r\nHost: localhost\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n"))
+	head, _ = readResponse(t, bufio.NewReader(client))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 431 "), head)
+
+	client = serveTestConnWith(t, server)
+	go client.Write([]byte("GET /hello HTTP/1.1\r\nHost: localhost\r\nA: 1\r\n\r\n"))
+	head, _ = readResponse(t, bufio.NewReader(client))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 "), head)
+}
+
+func TestHeadResponseHasNoBody(t *testing.T) {
+	client := serveTestConn(t, newTestMux())
+	go client.Write([]byte("HEAD /hello HTTP/1.1\r\nHost: localhost\r\n\r\nGET /hello HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	reader := bufio.NewReader(client)
+	var head strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	assert.True(t, strings.HasPrefix(head.String(), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, strings.ToLower(head.String()), "content-length: 5")
+
+	// the next bytes on the wire belong to the GET response, not to a HEAD body
+	nextHead, body := readResponse(t, reader)
+	assert.True(t, strings.HasPrefix(nextHead, "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, "hello", body)
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	mux := NewServerMux()
+	echo := func(w response.ResponseWriter, r *request.Request) {
+		body, err := r.ReadBody()
+		if err != nil {
+			w.CustomWriteHeader(response.StatusBadRequest)
+			return
+		}
+		w.Write(body)
+	}
+	mux.HandleFunc("POST", "/small", echo)
+	mux.HandleFunc("POST", "/upload", echo, handler.MaxBodyBytes(16))
+	server := &Server{Handler: mux, MaxBodyBytes: 4}
+
+	client := serveTestConnWith(t, server)
+	go client.Write([]byte("POST /small HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nabcd" +
+		"POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\n0123456789" +
+		"POST /small HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\n0123456789"))
+	reader := bufio.NewReader(client)
+	_, body := readResponse(t, reader)
+	assert.Equal(t, "abcd", body)
+	_, body = readResponse(t, reader)
+	assert.Equal(t, "0123456789", body)
+	head, _ := readResponse(t, reader)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 413 Content Too Large"), head)
+	assert.Contains(t, head, "Connection: close")
+
+	// a chunked body has no length to check up front, so it is cut off once it goes over the limit
+	client = serveTestConnWith(t, server)
+	go client.Write([]byte("POST /small HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n3\r\ndef\r\n0\r\n\r\n"))
+	head, _ = readResponse(t, bufio.NewReader(client))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 413"), head)
+}
+
+func TestObsFoldPolicy(t *testing.T) {
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/fold", func(w response.ResponseWriter, r *request.Request) {
+		value, _ := r.Headers.Get("X-Folded")
+		w.Write([]byte(value))
+	})
+	data := "GET /fold HTTP/1.1\r\nHost: localhost\r\nX-Folded: a\r\n b\r\n\r\n"
+
+	client := serveTestConn(t, mux)
+	go client.Write([]byte(data))
+	head, _ := readResponse(t, bufio.NewReader(client))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 400 "), head)
+
+	client = serveTestConnWith(t, &Server{Handler: mux, ObsFold: headers.FoldNormalize})
+	go client.Write([]byte(data))
+	_, body := readResponse(t, bufio.NewReader(client))
+	assert.Equal(t, "a b", body)
+}
+
+func TestPanicBeforeHeadersSends500(t *testing.T) {
+	var logs strings.Builder
+	mux := newTestMux()
+	mux.HandleFunc("GET", "/panic", func(w response.ResponseWriter, r *request.Request) {
+		w.GetHeaders().Set("X-Half-Done", "1")
+		w.Write([]byte("never sent"))
+		panic("something broke")
+	})
+	client := serveTestConnWith(t, &Server{Handler: mux, ErrorLog: log.New(&logs, "", 0)})
+	go client.Write([]byte("GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	reader := bufio.NewReader(client)
+	head, body := readResponse(t, reader)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 500 Internal Server Error"), head)
+	assert.NotContains(t, head, "X-Half-Done")
+	assert.Contains(t, head, "Connection: close")
+	assert.Equal(t, "500 Internal Server Error", body)
+	_, err := reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	assert.Contains(t, logs.String(), "Panic serving GET /panic: something broke")
+	assert.Contains(t, logs.String(), "goroutine")
+}
+
+func TestPanicAfterHeadersClosesConnection(t *testing.T) {
+	var logs strings.Builder
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/stream", func(w response.ResponseWriter, r *request.Request) {
+		w.Write([]byte("partial"))
+		w.(*response.Response).Flush()
+		panic(ErrAbortHandler)
+	})
+	client := serveTestConnWith(t, &Server{Handler: mux, ErrorLog: log.New(&logs, "", 0)})
+	go client.Write([]byte("GET /stream HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	data, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "HTTP/1.1 200 OK"))
+	assert.True(t, strings.HasSuffix(string(data), "7\r\npartial\r\n"), "the response must not be finished with a last chunk")
+	assert.Empty(t, logs.String(), "ErrAbortHandler should not be logged")
+}
+
+// lockedBuffer is a log destination that connections may write to while the test reads it.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b strings.Builder
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+func TestClientErrorsAreNotLogged(t *testing.T) {
+	var logs lockedBuffer
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/slow", func(w response.ResponseWriter, r *request.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("too late"))
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &Server{Handler: mux, ErrorLog: log.New(&logs, "", 0), MaxHeaderCount: 2}
+	go server.Serve(listener)
+
+	for _, raw := range []string{
+		"GARBAGE\r\n\r\n",
+		"GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n",
+		"GET / HTTP/2.0\r\n\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		conn.Write([]byte(raw))
+		data, _ := io.ReadAll(conn)
+		conn.Close()
+		assert.True(t, strings.HasPrefix(string(data), "HTTP/1.1 4") || strings.HasPrefix(string(data), "HTTP/1.1 5"), raw)
+	}
+
+	// a connection cut by Close fails its write, which is not an error either
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	<-started
+	server.Close()
+	close(release)
+	// the connection is no longer tracked once closed, so there is nothing to wait on but the clock
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, logs.String())
+}
+
+func gunzipBody(t *testing.T, body string) string {
+	decoder, err := gzip.NewReader(strings.NewReader(body))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(decoder)
+	require.NoError(t, err)
+	return string(plain)
+}
+
+func TestCompressedResponseFraming(t *testing.T) {
+	small := strings.Repeat("the same line over and over\n", 1000)
+	// hex digits of a seeded random source only compress to about half, which is still far more than the response buffers
+	random := rand.New(rand.NewSource(1))
+	large := make([]byte, 64 * 1024)
+	for i := range large {
+		large[i] = "0123456789abcdef"[random.Intn(16)]
+	}
+	mux := NewServerMux()
+	mux.Use(handler.Compress(gzip.BestSpeed))
+	mux.HandleFunc("GET", "/small", func(w response.ResponseWriter, r *request.Request) {
+		w.GetHeaders().Set("Content-Type", "text/plain")
+		w.GetHeaders().Set("Content-Length", strconv.Itoa(len(small)))
+		w.Write([]byte(small))
+	})
+	mux.HandleFunc("GET", "/large", func(w response.ResponseWriter, r *request.Request) {
+		w.GetHeaders().Set("Content-Type", "text/plain")
+		w.GetHeaders().Set("Content-Length", strconv.Itoa(len(large)))
+		w.Write(large)
+	})
+
+	// a compressed body that fits in the response buffer is sent with its real, compressed length
+	client := serveTestConn(t, mux)
+	go client.Write([]byte("GET /small HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n"))
+	head, body := readResponse(t, bufio.NewReader(client))
+	assert.Contains(t, head, "Content-Encoding: gzip")
+	assert.Contains(t, head, "Content-Length: " + strconv.Itoa(len(body)))
+	assert.Equal(t, small, gunzipBody(t, body))
+
+	// one that doesn't falls back to chunked framing
+	client = serveTestConn(t, mux)
+	go client.Write([]byte("GET /large HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\nConnection: close\r\n\r\n"))
+	head, body = readResponse(t, bufio.NewReader(client))
+	assert.Contains(t, head, "Content-Encoding: gzip")
+	assert.Contains(t, head, "Transfer-Encoding: chunked")
+	assert.NotContains(t, head, "Content-Length")
+	compressed, err := io.ReadAll(httputil.NewChunkedReader(strings.NewReader(body)))
+	require.NoError(t, err)
+	assert.Equal(t, string(large), gunzipBody(t, string(compressed)))
+}
+
+func TestDecompressedUploads(t *testing.T) {
+	mux := NewServerMux()
+	mux.HandleFunc("POST", "/upload", func(w response.ResponseWriter, r *request.Request) {
+		body, err := r.ReadBody()
+		if err != nil {
+			return
+		}
+		w.Write(body)
+	}, handler.Decompress(64))
+
+	var compressed strings.Builder
+	encoder := gzip.NewWriter(&compressed)
+	encoder.Write([]byte("hello from a gzip upload"))
+	encoder.Close()
+	var bomb strings.Builder
+	encoder = gzip.NewWriter(&bomb)
+	encoder.Write(make([]byte, 64 * 1024))
+	encoder.Close()
+
+	client := serveTestConn(t, mux)
+	go client.Write([]byte("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: gzip\r\nContent-Length: " +
+		strconv.Itoa(compressed.Len()) + "\r\n\r\n" + compressed.String() +
+		"POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: gzip\r\nContent-Length: " +
+		strconv.Itoa(bomb.Len()) + "\r\n\r\n" + bomb.String()))
+	reader := bufio.NewReader(client)
+	_, body := readResponse(t, reader)
+	assert.Equal(t, "hello from a gzip upload", body)
+	head, _ := readResponse(t, reader)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 413 Content Too Large"), head)
+	assert.Contains(t, head, "Connection: close")
+}
+
+func TestEventStreamEndsWhenClientLeaves(t *testing.T) {
+	left := make(chan error, 1)
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/events", func(w response.ResponseWriter, r *request.Request) {
+		stream, err := sse.NewStream(w, r)
+		require.NoError(t, err)
+		defer stream.Close()
+		stream.StartHeartbeat(time.Hour)
+		require.NoError(t, stream.Send(sse.Event{ID: "1", Data: "resumed after " + sse.LastEventID(r)}))
+		<-stream.Done()
+		left <- stream.Send(sse.Event{Data: "nobody is listening"})
+	})
+	client := serveTestConn(t, mux)
+	go client.Write([]byte("GET /events HTTP/1.1\r\nHost: localhost\r\nLast-Event-ID: 0\r\n\r\n"))
+
+	reader := bufio.NewReader(client)
+	var head strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	assert.Contains(t, head.String(), "Content-Type: text/event-stream")
+	assert.Contains(t, head.String(), "Transfer-Encoding: chunked")
+	events := bufio.NewReader(httputil.NewChunkedReader(reader))
+	event := ""
+	for !strings.HasSuffix(event, "\n\n") {
+		line, err := events.ReadString('\n')
+		require.NoError(t, err)
+		event += line
+	}
+	assert.Equal(t, "id: 1\ndata: resumed after 0\n\n", event)
+
+	client.Close()
+	select {
+	case err := <-left:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the handler was never told the client left")
+	}
+}
+
+func TestContextCanceledAfterHandler(t *testing.T) {
+	var ctx context.Context
+	mux := NewServerMux()
+	mux.HandleFunc("POST", "/", func(w response.ResponseWriter, r *request.Request) {
+		ctx = r.Context()
+		body, _ := r.ReadBody()
+		assert.NoError(t, ctx.Err(), "reading the body must not cancel the request")
+		w.Write(body)
+	})
+	client := serveTestConn(t, mux)
+	go client.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello" +
+		"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nworld"))
+	reader := bufio.NewReader(client)
+	_, body := readResponse(t, reader)
+	assert.Equal(t, "hello", body)
+	_, body = readResponse(t, reader)
+	assert.Equal(t, "world", body)
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+}
+
+func TestContextCanceledAfterExactRead(t *testing.T) {
+	read := make(chan struct{})
+	left := make(chan error, 1)
+	mux := NewServerMux()
+	mux.HandleFunc("POST", "/", func(w response.ResponseWriter, r *request.Request) {
+		// the handler knows how long the body is, so it never reads again to see the EOF
+		body := make([]byte, 5)
+		_, err := io.ReadFull(r.BodyReader, body)
+		require.NoError(t, err)
+		close(read)
+		select {
+		case <-r.Context().Done():
+			left <- r.Context().Err()
+		case <-time.After(2 * time.Second):
+			left <- nil
+		}
+	})
+	client := serveTestConn(t, mux)
+	go client.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello"))
+	<-read
+	client.Close()
+	assert.ErrorIs(t, <-left, context.Canceled, "the handler was never told the client left")
+}
+
+func TestHijackedConnection(t *testing.T) {
+	hijacked := make(chan net.Conn, 1)
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/raw", func(w response.ResponseWriter, r *request.Request) {
+		conn, rw, err := w.(response.Hijacker).Hijack()
+		require.NoError(t, err)
+		// the client sent more right after the request, which the server had already read ahead
+		line, err := rw.ReadString('\n')
+		require.NoError(t, err)
+		rw.WriteString("got " + line)
+		rw.Flush()
+		hijacked <- conn
+	})
+	s := &Server{Handler: mux, WriteTimeout: 10 * time.Millisecond}
+	client := serveTestConnWith(t, s)
+	go client.Write([]byte("GET /raw HTTP/1.1\r\nHost: localhost\r\n\r\nhello\n"))
+
+	reader := bufio.NewReader(client)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "got hello\n", line)
+
+	// the handler has returned, but the connection now belongs to it: the server neither closes it nor times it out
+	conn := <-hijacked
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, s.Close())
+	go conn.Write([]byte("still open\n"))
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "still open\n", line)
+	conn.Close()
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+	"github.com/juancruzfl/httpserver/internal/handler"
+	"github.com/juancruzfl/httpserver/internal/response"
+)
+
+// defaultTLSHandshakeTimeout bounds the handshake when the server has no ReadHeaderTimeout or ReadTimeout of its own, since a client that
+// never finishes the handshake would otherwise hold on to its goroutine forever.
+const defaultTLSHandshakeTimeout = 10 * time.Second
+
+// ListenAndServeTLS is ListenAndServe over TLS, listening on ":8443" when Addr is empty. The certificate and key are read from the PEM files
+// certFile and keyFile and added to the certificates of TLSConfig. Both may be empty if TLSConfig already has its certificates.
+func (s *Server) ListenAndServeTLS(certFile string, keyFile string) error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	addr := s.Addr
+	if addr == "" {
+		addr = ":8443"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(listener, certFile, keyFile)
+}
+
+// ServeTLS is Serve over TLS, see ListenAndServeTLS for the certificate files.
+//
+// sidenote: SNI and client certificates (mTLS) are configured on TLSConfig the way crypto/tls always does it. With several Certificates the one
+// matching the server name the client asked for is picked, GetCertificate takes over that choice entirely, and ClientAuth together with ClientCAs
+// asks for and verifies client certificates. Whatever was negotiated ends up on Request.TLS.
+func (s *Server) ServeTLS(listener net.Listener, certFile string, keyFile string) error {
+	config, err := s.tlsConfig(certFile, keyFile)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	return s.Serve(tls.NewListener(listener, config))
+}
+
+func (s *Server) tlsConfig(certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if s.TLSConfig != nil {
+		config = s.TLSConfig.Clone()
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		return nil, errors.New("No TLS certificate configured")
+	}
+	return config, nil
+}
+
+func (s *Server) tlsHandshakeTimeout() time.Duration {
+	if timeout := s.readHeaderTimeout(); timeout > 0 {
+		return timeout
+	}
+	return defaultTLSHandshakeTimeout
+}
+
+// handshake runs the TLS handshake of a new connection and returns what was negotiated. A client speaking plain HTTP to the TLS port gets a 400
+// in plain HTTP, which is a lot more helpful than a closed connection.
+func (s *Server) handshake(conn *tls.Conn) (*tls.ConnectionState, error) {
+	conn.SetDeadline(time.Now().Add(s.tlsHandshakeTimeout()))
+	if err := conn.Handshake(); err != nil {
+		var recordErr tls.RecordHeaderError
+		if errors.As(err, &recordErr) && recordErr.Conn != nil && looksLikeHTTP(recordErr.RecordHeader[:]) {
+			sendStatus(recordErr.Conn, response.StatusBadRequest)
+			return nil, nil
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	state := conn.ConnectionState()
+	return &state, nil
+}
+
+func looksLikeHTTP(header []byte) bool {
+	switch string(header) {
+	case "GET /", "HEAD ", "POST ", "PUT /", "OPTIO", "DELET", "PATCH":
+		return true
+	}
+	return false
+}
+
+// CustomListenAndServeTLS is CustomListenAndServe over TLS.
+func CustomListenAndServeTLS(addr string, certFile string, keyFile string, h handler.Handler) error {
+	server := &Server{Addr: addr, Handler: h}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"github.com/juancruzfl/httpserver/internal/request"
+	"github.com/juancruzfl/httpserver/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCert is a certificate generated for a test, signed by parent or self-signed when parent is nil.
+type testCert struct {
+	cert *x509.Certificate
+	key *ecdsa.PrivateKey
+	tls tls.Certificate
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1 << 62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA: isCA,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key, tls: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}}
+}
+
+// writePEM writes the certificate and its key to PEM files in a temp dir, returning their paths.
+func (c *testCert) writePEM(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func (c *testCert) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return pool
+}
+
+func startTLSServer(t *testing.T, server *Server, certFile string, keyFile string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.ServeTLS(listener, certFile, keyFile)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+func tlsMux() *MyServerMux {
+	mux := NewServerMux()
+	mux.HandleFunc("GET", "/whoami", func(w response.ResponseWriter, r *request.Request) {
+		if r.TLS == nil {
+			w.Write([]byte("plain"))
+			return
+		}
+		name := "anonymous"
+		if len(r.TLS.PeerCertificates) > 0 {
+			name = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		w.Write([]byte(r.TLS.ServerName + " " + name))
+	})
+	return mux
+}
+
+func tlsGet(t *testing.T, addr string, config *tls.Config) (string, string) {
+	conn, err := tls.Dial("tcp", addr, config)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /whoami HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	return readResponse(t, bufio.NewReader(conn))
+}
+
+func TestListenAndServeTLSWithCertFiles(t *testing.T) {
+	cert := newTestCert(t, "localhost", nil, false)
+	certFile, keyFile := cert.writePEM(t)
+	addr := startTLSServer(t, &Server{Handler: tlsMux()}, certFile, keyFile)
+
+	head, body := tlsGet(t, addr, &tls.Config{RootCAs: cert.pool(), ServerName: "localhost"})
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK"), head)
+	assert.Equal(t, "localhost anonymous", body)
+}
+
+func TestTLSSelectsCertificateBySNI(t *testing.T) {
+	ca := newTestCert(t, "Test CA", nil, true)
+	first := newTestCert(t, "first.test", ca, false)
+	second := newTestCert(t, "second.test", ca, false)
+	server := &Server{Handler: tlsMux(), TLSConfig: &tls.Config{Certificates: []tls.Certificate{first.tls, second.tls}}}
+	addr := startTLSServer(t, server, "", "")
+
+	for _, name := range []string{"first.test", "second.test"} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool(), ServerName: name})
+		require.NoError(t, err)
+		assert.Equal(t, name, conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+		conn.Close()
+	}
+}
+
+func TestTLSClientCertificates(t *testing.T) {
+	ca := newTestCert(t, "Test CA", nil, true)
+	serverCert := newTestCert(t, "localhost", ca, false)
+	clientCert := newTestCert(t, "alice", ca, false)
+	server := &Server{Handler: tlsMux(), TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tls},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs: ca.pool(),
+	}}
+	addr := startTLSServer(t, server, "", "")
+
+	_, body := tlsGet(t, addr, &tls.Config{RootCAs: ca.pool(), ServerName: "localhost", Certificates: []tls.Certificate{clientCert.tls}})
+	assert.Equal(t, "localhost alice", body)
+
+	// without a client certificate the handshake has to fail, on the client side at the latest when it first reads
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool(), ServerName: "localhost"})
+	if err == nil {
+		defer conn.Close()
+		conn.Write([]byte("GET /whoami HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		_, err = bufio.NewReader(conn).ReadString('\n')
+	}
+	assert.Error(t, err)
+}
+
+func TestPlainHTTPToTLSPort(t *testing.T) {
+	cert := newTestCert(t, "localhost", nil, false)
+	addr := startTLSServer(t, &Server{Handler: tlsMux(), TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert.tls}}}, "", "")
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /whoami HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	head, _ := readResponse(t, bufio.NewReader(conn))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 400 "), head)
+}
+
+func TestServeTLSWithoutCertificate(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	assert.Error(t, (&Server{}).ServeTLS(listener, "", ""))
+}
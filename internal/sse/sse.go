@@ -0,0 +1,223 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/juancruzfl/httpserver/internal/request"
+	"github.com/juancruzfl/httpserver/internal/response"
+)
+
+var (
+	// ErrStreamingUnsupported is returned by NewStream when the ResponseWriter can't flush, so events would sit in a buffer instead of reaching the client.
+	ErrStreamingUnsupported = errors.New("Response writer does not support flushing")
+	ErrInvalidEvent = errors.New("Invalid event")
+	ErrStreamClosed = errors.New("Event stream closed")
+)
+
+// Event is a single server-sent event. Only the fields that are set are sent. An event with an empty Data and Event only updates the last event
+// ID or the reconnection time of the client, without dispatching anything to it.
+type Event struct {
+	// ID is what the client sends back in Last-Event-ID when it reconnects.
+	ID string
+	// Event is the event type, which the client listens for with addEventListener. Empty means "message".
+	Event string
+	// Data is the payload. It may span several lines.
+	Data string
+	// Retry tells the client how long to wait before reconnecting after losing the stream.
+	Retry time.Duration
+}
+
+// WriteTo writes the event in the text/event-stream format, ending in the blank line that dispatches it.
+//
+// sidenote: the format is line based, with a line break ending the value of a field. A line break inside ID or Event would let whoever controls
+// the value inject fields of its own, so those are refused. Data is the one field that may span lines, and is sent as one data field per line,
+// which the client joins back with line feeds.
+func (e Event) WriteTo(w io.Writer) (int64, error) {
+	if strings.ContainsAny(e.ID, "\r\n\x00") {
+		return 0, fmt.Errorf("%w: ID %q contains a line break or NUL", ErrInvalidEvent, e.ID)
+	}
+	if strings.ContainsAny(e.Event, "\r\n") {
+		return 0, fmt.Errorf("%w: Event %q contains a line break", ErrInvalidEvent, e.Event)
+	}
+	if e.Retry < 0 {
+		return 0, fmt.Errorf("%w: negative Retry", ErrInvalidEvent)
+	}
+
+	var b strings.Builder
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	if e.Data != "" || e.Event != "" {
+		data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+		data = strings.ReplaceAll(data, "\r", "\n")
+		for _, line := range strings.Split(data, "\n") {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+	b.WriteString("\n")
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// LastEventID returns the ID of the last event the client received before it lost the stream, or "" on a first connection. A handler uses it
+// to resume the stream where it left off.
+func LastEventID(r *request.Request) string {
+	id, _ := r.Headers.Get("Last-Event-ID")
+	if strings.ContainsAny(id, "\r\n\x00") {
+		return ""
+	}
+	return id
+}
+
+// Stream sends events to a single client. It is safe to use from several goroutines, but the handler must not write to the ResponseWriter
+// itself once the stream is open, and must Close the stream before it returns.
+type Stream struct {
+	w response.ResponseWriter
+	flusher response.Flusher
+	ctx context.Context
+	mu sync.Mutex
+	// err is sticky: once a write has failed, or the stream was closed, every later send returns it
+	err error
+	stop chan struct{}
+	heartbeatDone chan struct{}
+}
+
+// NewStream answers the request with an event stream and sends the headers right away, so the client knows the stream is open before the first
+// event. The stream ends when the client goes away, which shows up as Send returning the error of the request context.
+func NewStream(w response.ResponseWriter, r *request.Request) (*Stream, error) {
+	flusher, ok := w.(response.Flusher)
+	if !ok {
+		return nil, ErrStreamingUnsupported
+	}
+	h := w.GetHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	// a proxy or browser cache holding on to the stream would hand out stale events, or none at all
+	h.Set("Cache-Control", "no-cache")
+	h.Del("Content-Length")
+	w.CustomWriteHeader(response.StatusOK)
+	if err := flusher.Flush(); err != nil {
+		return nil, err
+	}
+	return &Stream{w: w, flusher: flusher, ctx: r.Context()}, nil
+}
+
+// Send writes the event and flushes it to the client.
+func (s *Stream) Send(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(); err != nil {
+		return err
+	}
+	if _, err := e.WriteTo(s.w); err != nil {
+		if errors.Is(err, ErrInvalidEvent) {
+			return err
+		}
+		s.err = err
+		return err
+	}
+	return s.flush()
+}
+
+// Comment sends a comment line, which the client ignores. It is mostly useful to keep idle connections from being closed by proxies.
+func (s *Stream) Comment(text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		b.WriteString(":" + line + "\n")
+	}
+	b.WriteString("\n")
+	if _, err := io.WriteString(s.w, b.String()); err != nil {
+		s.err = err
+		return err
+	}
+	return s.flush()
+}
+
+// check must be called with mu held.
+func (s *Stream) check() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.ctx.Err()
+}
+
+func (s *Stream) flush() error {
+	if err := s.flusher.Flush(); err != nil {
+		s.err = err
+		return err
+	}
+	return nil
+}
+
+// StartHeartbeat sends a comment every interval until the stream is closed or the client goes away. Proxies tend to drop connections that stay
+// silent for a minute or so, and writing is also how a dead connection that never said goodbye is eventually noticed. An interval that is not
+// positive starts nothing.
+func (s *Stream) StartHeartbeat(interval time.Duration) {
+	// sidenote: a ticker panics on a non-positive interval, and in the heartbeat goroutine nothing would recover it before it took the server down
+	if interval <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil || s.err != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.heartbeatDone = make(chan struct{})
+	go s.heartbeat(interval, s.stop, s.heartbeatDone)
+}
+
+func (s *Stream) heartbeat(interval time.Duration, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Comment("heartbeat"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Done returns a channel that is closed once the client has gone away.
+func (s *Stream) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Close stops the heartbeat and waits for it to finish, after which the handler may return. Sends after Close fail with ErrStreamClosed.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	stop, done := s.stop, s.heartbeatDone
+	s.stop = nil
+	if s.err == nil {
+		s.err = ErrStreamClosed
+	}
+	s.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"github.com/juancruzfl/httpserver/internal/headers"
+	"github.com/juancruzfl/httpserver/internal/request"
+	"github.com/juancruzfl/httpserver/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is a ResponseWriter that can flush, keeping what was flushed apart from what is still buffered.
+type recorder struct {
+	mu sync.Mutex
+	status int
+	headers *headers.Headers
+	pending strings.Builder
+	flushed strings.Builder
+	flushes int
+}
+
+func newRecorder() *recorder {
+	return &recorder{headers: headers.NewHeaders()}
+}
+
+func (r *recorder) GetHeaders() *headers.Headers { return r.headers }
+
+func (r *recorder) CustomWriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *recorder) Write(data []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pending.Write(data)
+}
+
+func (r *recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushed.WriteString(r.pending.String())
+	r.pending.Reset()
+	r.flushes++
+	return nil
+}
+
+func (r *recorder) output() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.flushed.String()
+}
+
+// plainWriter can't flush.
+type plainWriter struct {
+	*recorder
+}
+
+func (p plainWriter) Flush() {}
+
+func newTestRequest(lastEventID string) *request.Request {
+	hs := headers.NewHeaders()
+	if lastEventID != "" {
+		hs.Set("Last-Event-ID", lastEventID)
+	}
+	return request.NewMockRequest(request.NewMockRequestLine("1.1", "/events", "GET"), *hs, nil, 0)
+}
+
+func TestEventFormat(t *testing.T) {
+	cases := []struct {
+		name string
+		event Event
+		expected string
+	}{
+		{"data only", Event{Data: "hello"}, "data: hello\n\n"},
+		{"all fields", Event{ID: "7", Event: "update", Data: "{\"n\":1}", Retry: 3 * time.Second},
+			"id: 7\nevent: update\nretry: 3000\ndata: {\"n\":1}\n\n"},
+		{"multiline data", Event{Data: "one\ntwo\r\nthree\rfour"}, "data: one\ndata: two\ndata: three\ndata: four\n\n"},
+		{"trailing newline", Event{Data: "line\n"}, "data: line\ndata: \n\n"},
+		{"typed without data", Event{Event: "ping"}, "event: ping\ndata: \n\n"},
+		{"id only", Event{ID: "42"}, "id: 42\n\n"},
+	}
+	for _, c := range cases {
+		var b strings.Builder
+		n, err := c.event.WriteTo(&b)
+		require.NoError(t, err, c.name)
+		assert.Equal(t, c.expected, b.String(), c.name)
+		assert.Equal(t, int64(len(c.expected)), n, c.name)
+	}
+}
+
+func TestEventRejectsInjection(t *testing.T) {
+	for _, event := range []Event{
+		{ID: "1\ndata: injected"},
+		{ID: "1\x00"},
+		{Event: "update\r\nid: 9"},
+		{Data: "ok", Retry: -time.Second},
+	} {
+		var b strings.Builder
+		_, err := event.WriteTo(&b)
+		assert.ErrorIs(t, err, ErrInvalidEvent)
+		assert.Empty(t, b.String())
+	}
+}
+
+func TestLastEventID(t *testing.T) {
+	assert.Equal(t, "", LastEventID(newTestRequest("")))
+	assert.Equal(t, "41", LastEventID(newTestRequest("41")))
+}
+
+func TestNewStream(t *testing.T) {
+	w := newRecorder()
+	w.headers.Set("Content-Length", "10")
+	stream, err := NewStream(w, newTestRequest(""))
+	require.NoError(t, err)
+	defer stream.Close()
+
+	assert.Equal(t, 200, w.status)
+	contentType, _ := w.headers.Get("Content-Type")
+	assert.Equal(t, "text/event-stream", contentType)
+	cacheControl, _ := w.headers.Get("Cache-Control")
+	assert.Equal(t, "no-cache", cacheControl)
+	_, hasLength := w.headers.Get("Content-Length")
+	assert.False(t, hasLength)
+	assert.Equal(t, 1, w.flushes, "the headers are flushed before the first event")
+
+	require.NoError(t, stream.Send(Event{ID: "1", Data: "first"}))
+	assert.Equal(t, "id: 1\ndata: first\n\n", w.output(), "every event is flushed as soon as it is sent")
+	assert.ErrorIs(t, stream.Send(Event{Event: "bad\nevent"}), ErrInvalidEvent)
+	require.NoError(t, stream.Comment("still here"))
+	assert.Equal(t, "id: 1\ndata: first\n\n:still here\n\n", w.output())
+}
+
+func TestNewStreamNeedsFlusher(t *testing.T) {
+	_, err := NewStream(plainWriter{newRecorder()}, newTestRequest(""))
+	assert.ErrorIs(t, err, ErrStreamingUnsupported)
+}
+
+func TestStreamEndsWithContext(t *testing.T) {
+	r := newTestRequest("")
+	ctx, cancel := context.WithCancel(context.Background())
+	r.SetContext(ctx)
+	stream, err := NewStream(newRecorder(), r)
+	require.NoError(t, err)
+	defer stream.Close()
+
+	cancel()
+	<-stream.Done()
+	assert.True(t, errors.Is(stream.Send(Event{Data: "late"}), context.Canceled))
+}
+
+func TestHeartbeat(t *testing.T) {
+	w := newRecorder()
+	stream, err := NewStream(w, newTestRequest(""))
+	require.NoError(t, err)
+	stream.StartHeartbeat(5 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return strings.Count(w.output(), ":heartbeat\n\n") >= 2
+	}, time.Second, 5 * time.Millisecond)
+
+	require.NoError(t, stream.Close())
+	sent := w.output()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, sent, w.output(), "no heartbeat is sent once the stream is closed")
+	assert.ErrorIs(t, stream.Send(Event{Data: "x"}), ErrStreamClosed)
+}
+
+func TestHeartbeatWithoutInterval(t *testing.T) {
+	w := newRecorder()
+	stream, err := NewStream(w, newTestRequest(""))
+	require.NoError(t, err)
+	assert.NotPanics(t, func() {
+		stream.StartHeartbeat(0)
+		stream.StartHeartbeat(-time.Second)
+	})
+	time.Sleep(10 * time.Millisecond)
+	assert.NotContains(t, w.output(), ":heartbeat")
+
+	// it did not use up the heartbeat of the stream either
+	stream.StartHeartbeat(5 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(w.output(), ":heartbeat\n\n")
+	}, time.Second, 5 * time.Millisecond)
+	require.NoError(t, stream.Close())
+}
+
+var _ response.Flusher = (*recorder)(nil)
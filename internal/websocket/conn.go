@@ -0,0 +1,568 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageType is the type of a data message.
+type MessageType int
+
+const (
+	TextMessage MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+const (
+	opContinuation byte = 0x0
+	opText byte = 0x1
+	opBinary byte = 0x2
+	opClose byte = 0x8
+	opPing byte = 0x9
+	opPong byte = 0xa
+)
+
+const (
+	finBit = 0x80
+	rsv1Bit = 0x40
+	rsv2Bit = 0x20
+	rsv3Bit = 0x10
+	maskBit = 0x80
+	// control frames can't be fragmented, and their payload has to fit the 7 bit length
+	maxControlPayload = 125
+)
+
+// Close codes from section 7.4.1 of RFC 6455.
+const (
+	CloseNormalClosure = 1000
+	CloseGoingAway = 1001
+	CloseProtocolError = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatusReceived = 1005
+	CloseAbnormalClosure = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig = 1009
+	CloseMandatoryExtension = 1010
+	CloseInternalServerErr = 1011
+)
+
+// DefaultReadLimit is the largest message a connection reads unless the Upgrader says otherwise.
+const DefaultReadLimit = 32 << 20
+
+// frameSize is the largest frame a message writer sends. Longer messages go out as several fragments, so a message doesn't have to be held in
+// memory as a whole before the first byte of it is sent.
+const frameSize = 4096
+
+// closeTimeout is how long Close waits for the peer to answer our close frame.
+const closeTimeout = 5 * time.Second
+
+// deflateTail is appended to a compressed message before inflating it: the sync flush marker the sender strips off, then an empty final block
+// so the inflater sees the stream end cleanly.
+const deflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+
+var (
+	// ErrProtocol is returned when the peer breaks the framing rules. The connection is failed with a 1002 close frame.
+	ErrProtocol = errors.New("WebSocket protocol error")
+	// ErrMessageTooBig is returned when a message goes over the read limit. The connection is failed with a 1009 close frame.
+	ErrMessageTooBig = errors.New("WebSocket message too big")
+	// ErrInvalidUTF8 is returned when a text message is not valid UTF-8. The connection is failed with a 1007 close frame.
+	ErrInvalidUTF8 = errors.New("Invalid UTF-8 in text message")
+	// ErrCloseSent is returned when writing after a close frame has been sent.
+	ErrCloseSent = errors.New("WebSocket close frame already sent")
+)
+
+// CloseError is returned by ReadMessage once the peer has sent a close frame. Code is CloseNoStatusReceived when the frame had no code.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	if e.Text == "" {
+		return fmt.Sprintf("WebSocket closed with code %d", e.Code)
+	}
+	return fmt.Sprintf("WebSocket closed with code %d: %s", e.Code, e.Text)
+}
+
+// flateWriters pools the compressors of messages, since without context takeover each message starts from a fresh state anyway.
+var flateWriters = sync.Pool{New: func() any {
+	w, _ := flate.NewWriter(io.Discard, flate.BestSpeed)
+	return w
+}}
+
+// Conn is a WebSocket connection. One goroutine may read while another writes. Ping, WriteClose and the pongs sent in answer to pings are
+// safe to call alongside both, but data messages must be written by one goroutine at a time.
+type Conn struct {
+	conn net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+	isServer bool
+	compress bool
+	subprotocol string
+	readLimit int64
+	// readErr is sticky: once reading has failed, or the peer has closed, every later read returns it
+	readErr error
+	pongHandler func(data []byte)
+
+	// failed is set once fail has closed the connection
+	failed bool
+
+	writeMu sync.Mutex
+	closeSent bool
+	writeErr error
+	writer *messageWriter
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, bw *bufio.Writer, isServer bool, compress bool) *Conn {
+	return &Conn{conn: conn, br: br, bw: bw, isServer: isServer, compress: compress, readLimit: DefaultReadLimit}
+}
+
+// Subprotocol returns the subprotocol picked during the handshake, or "" when there is none.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SetPongHandler sets a function called with the payload of every pong the peer sends, typically to push back a read deadline. It is called
+// from ReadMessage.
+func (c *Conn) SetPongHandler(fn func(data []byte)) {
+	c.pongHandler = fn
+}
+
+type frame struct {
+	fin bool
+	rsv1 bool
+	opcode byte
+	payload []byte
+}
+
+// readFrame reads the next frame. limit is how many payload bytes a data frame may still have.
+func (c *Conn) readFrame(limit int64) (frame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return frame{}, err
+	}
+	f := frame{fin: header[0] & finBit != 0, rsv1: header[0] & rsv1Bit != 0, opcode: header[0] & 0x0f}
+	if header[0] & (rsv2Bit | rsv3Bit) != 0 {
+		return f, c.fail(CloseProtocolError, ErrProtocol, "Reserved bits set")
+	}
+	// sidenote: clients mask every frame and servers none, so that a script in a browser can't make the bytes on the wire look like anything of
+	// its choosing to a proxy in between. A frame masked the wrong way means the peer isn't following the protocol.
+	masked := header[1] & maskBit != 0
+	if masked != c.isServer {
+		return f, c.fail(CloseProtocolError, ErrProtocol, "Frame masked the wrong way")
+	}
+
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.br, extended[:]); err != nil {
+			return f, err
+		}
+		length = int64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.br, extended[:]); err != nil {
+			return f, err
+		}
+		if extended[0] & 0x80 != 0 {
+			return f, c.fail(CloseProtocolError, ErrProtocol, "Frame length out of range")
+		}
+		length = int64(binary.BigEndian.Uint64(extended[:]))
+	}
+
+	if f.opcode >= opClose {
+		if !f.fin || length > maxControlPayload || f.rsv1 {
+			return f, c.fail(CloseProtocolError, ErrProtocol, "Invalid control frame")
+		}
+	} else if length > limit {
+		return f, c.fail(CloseMessageTooBig, ErrMessageTooBig, "Message over the read limit")
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, key[:]); err != nil {
+			return f, err
+		}
+	}
+	// sidenote: the length is only what the peer claims. Allocating it up front would let a client that sends a header and nothing else make us
+	// hold on to as much memory as the read limit allows, so the buffer grows with the bytes that actually arrive.
+	var payload bytes.Buffer
+	if _, err := io.CopyN(&payload, c.br, length); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return f, err
+	}
+	f.payload = payload.Bytes()
+	if masked {
+		maskBytes(key, f.payload)
+	}
+	return f, nil
+}
+
+// ReadMessage reads the next data message, putting its fragments back together and decompressing it. Pings are answered and pongs handed to
+// the pong handler along the way. Once the peer closes, the close is answered and a *CloseError is returned.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	var messageType MessageType
+	var data []byte
+	started, compressed := false, false
+	for {
+		f, err := c.readFrame(c.readLimit - int64(len(data)))
+		if err != nil {
+			if c.readErr == nil {
+				c.readErr = err
+			}
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, true, false, f.payload); err != nil && !errors.Is(err, ErrCloseSent) {
+				c.readErr = err
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			if c.pongHandler != nil {
+				c.pongHandler(f.payload)
+			}
+			continue
+		case opClose:
+			c.readErr = c.handleClose(f.payload)
+			return 0, nil, c.readErr
+		case opText, opBinary:
+			if started {
+				return 0, nil, c.fail(CloseProtocolError, ErrProtocol, "New message before the last one ended")
+			}
+			started = true
+			messageType = MessageType(f.opcode)
+			if f.rsv1 {
+				if !c.compress {
+					return 0, nil, c.fail(CloseProtocolError, ErrProtocol, "Compressed message without permessage-deflate")
+				}
+				compressed = true
+			}
+		case opContinuation:
+			if !started {
+				return 0, nil, c.fail(CloseProtocolError, ErrProtocol, "Continuation frame without a message")
+			}
+			if f.rsv1 {
+				return 0, nil, c.fail(CloseProtocolError, ErrProtocol, "Reserved bit set on a continuation frame")
+			}
+		default:
+			return 0, nil, c.fail(CloseProtocolError, ErrProtocol, fmt.Sprintf("Unknown opcode %d", f.opcode))
+		}
+
+		data = append(data, f.payload...)
+		if !f.fin {
+			continue
+		}
+		if compressed {
+			if data, err = c.inflate(data); err != nil {
+				return 0, nil, err
+			}
+		}
+		if messageType == TextMessage && !utf8.Valid(data) {
+			return 0, nil, c.fail(CloseInvalidFramePayloadData, ErrInvalidUTF8, "Text message is not valid UTF-8")
+		}
+		return messageType, data, nil
+	}
+}
+
+func (c *Conn) inflate(data []byte) ([]byte, error) {
+	reader := flate.NewReader(io.MultiReader(bytes.NewReader(data), strings.NewReader(deflateTail)))
+	defer reader.Close()
+	// sidenote: the read limit is checked again on the output, since a few kilobytes of deflate can expand to gigabytes
+	out, err := io.ReadAll(io.LimitReader(reader, c.readLimit + 1))
+	if err != nil {
+		return nil, c.fail(CloseInvalidFramePayloadData, ErrProtocol, "Invalid compressed message")
+	}
+	if int64(len(out)) > c.readLimit {
+		return nil, c.fail(CloseMessageTooBig, ErrMessageTooBig, "Message over the read limit")
+	}
+	return out, nil
+}
+
+// handleClose answers a close frame of the peer, unless it is the answer to ours, and returns the error ReadMessage reports from then on.
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+	var reply []byte
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, ErrProtocol, "Close frame with a one byte payload")
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Text = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(CloseProtocolError, ErrProtocol, fmt.Sprintf("Invalid close code %d", closeErr.Code))
+		}
+		if !utf8.ValidString(closeErr.Text) {
+			return c.fail(CloseInvalidFramePayloadData, ErrInvalidUTF8, "Close reason is not valid UTF-8")
+		}
+		reply = payload[:2]
+	}
+	if err := c.writeFrame(opClose, true, false, reply); err != nil && !errors.Is(err, ErrCloseSent) {
+		return err
+	}
+	return closeErr
+}
+
+// validCloseCode reports whether a close code may appear in a close frame. 1005, 1006 and 1015 are only ever reported locally.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// fail fails the connection: it sends a close frame with the code, closes the connection and makes the error sticky for later reads.
+func (c *Conn) fail(code int, sentinel error, reason string) error {
+	err := fmt.Errorf("%w: %s", sentinel, reason)
+	c.WriteClose(code, reason)
+	c.conn.Close()
+	c.failed = true
+	c.readErr = err
+	return err
+}
+
+// writeFrame writes a single frame and flushes it.
+func (c *Conn) writeFrame(opcode byte, fin bool, rsv1 bool, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	if c.closeSent {
+		return ErrCloseSent
+	}
+
+	header := make([]byte, 0, 14)
+	b0 := opcode
+	if fin {
+		b0 |= finBit
+	}
+	if rsv1 {
+		b0 |= rsv1Bit
+	}
+	var b1 byte
+	if !c.isServer {
+		b1 = maskBit
+	}
+	switch length := len(payload); {
+	case length <= 125:
+		header = append(header, b0, b1 | byte(length))
+	case length <= 0xffff:
+		header = append(header, b0, b1 | 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header = append(header, b0, b1 | 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+	if !c.isServer {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		header = append(header, key[:]...)
+		masked := make([]byte, len(payload))
+		copy(masked, payload)
+		maskBytes(key, masked)
+		payload = masked
+	}
+
+	c.bw.Write(header)
+	c.bw.Write(payload)
+	if err := c.bw.Flush(); err != nil {
+		c.writeErr = err
+		return err
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+	return nil
+}
+
+func maskBytes(key [4]byte, data []byte) {
+	for i := range data {
+		data[i] ^= key[i & 3]
+	}
+}
+
+// Ping sends a ping. The peer answers it with a pong carrying the same data, which shows up in the pong handler.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return fmt.Errorf("Ping payload of %d bytes is over %d", len(data), maxControlPayload)
+	}
+	return c.writeFrame(opPing, true, false, data)
+}
+
+// WriteClose sends a close frame, after which nothing else can be written. The peer answers with a close frame of its own, which ReadMessage
+// reports as a *CloseError.
+func (c *Conn) WriteClose(code int, text string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, text...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	return c.writeFrame(opClose, true, false, payload)
+}
+
+// Close runs the closing handshake: it sends a normal closure, waits up to closeTimeout for the close frame of the peer and closes the
+// connection. It must not be called while another goroutine is in ReadMessage; that goroutine should call WriteClose and see the answer
+// come in instead.
+func (c *Conn) Close() error {
+	if c.failed {
+		return nil
+	}
+	if err := c.WriteClose(CloseNormalClosure, ""); err == nil && c.readErr == nil {
+		c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				break
+			}
+		}
+	}
+	return c.conn.Close()
+}
+
+// WriteMessage sends a data message.
+func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	w, err := c.NextWriter(messageType)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// NextWriter starts a data message and returns a writer for its body, which is sent in fragments as it is written. Closing the writer ends the
+// message. Starting a new message closes the writer of the previous one.
+func (c *Conn) NextWriter(messageType MessageType) (io.WriteCloser, error) {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return nil, fmt.Errorf("Invalid message type %d", messageType)
+	}
+	if c.writer != nil {
+		if err := c.writer.Close(); err != nil {
+			return nil, err
+		}
+	}
+	frames := &frameWriter{c: c, opcode: byte(messageType)}
+	w := &messageWriter{c: c, frames: frames}
+	if c.compress {
+		frames.rsv1 = true
+		// the sync flush marker at the end of the compressed message is stripped, so its last 4 bytes have to stay around until the end
+		frames.holdBack = 4
+		w.flate = flateWriters.Get().(*flate.Writer)
+		w.flate.Reset(frames)
+	}
+	c.writer = w
+	return w, nil
+}
+
+// frameWriter cuts what is written to it into frames of frameSize bytes, holding back the last holdBack bytes.
+type frameWriter struct {
+	c *Conn
+	opcode byte
+	rsv1 bool
+	buffer []byte
+	holdBack int
+	err error
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	f.buffer = append(f.buffer, p...)
+	for len(f.buffer) - f.holdBack > frameSize {
+		if err := f.send(f.buffer[:frameSize], false); err != nil {
+			return 0, err
+		}
+		f.buffer = append(f.buffer[:0], f.buffer[frameSize:]...)
+	}
+	return len(p), nil
+}
+
+// send writes a frame. Only the first frame of a message carries its opcode and the compression bit, the rest are continuations.
+func (f *frameWriter) send(payload []byte, fin bool) error {
+	err := f.c.writeFrame(f.opcode, fin, f.rsv1, payload)
+	f.opcode = opContinuation
+	f.rsv1 = false
+	f.err = err
+	return err
+}
+
+type messageWriter struct {
+	c *Conn
+	frames *frameWriter
+	flate *flate.Writer
+	closed bool
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("Write on closed message writer")
+	}
+	if w.flate != nil {
+		return w.flate.Write(p)
+	}
+	return w.frames.Write(p)
+}
+
+// Close sends the last frame of the message.
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.c.writer == w {
+		w.c.writer = nil
+	}
+	if w.flate != nil {
+		err := w.flate.Flush()
+		w.flate.Reset(io.Discard)
+		flateWriters.Put(w.flate)
+		w.flate = nil
+		if err != nil {
+			return err
+		}
+		w.frames.buffer = bytes.TrimSuffix(w.frames.buffer, []byte("\x00\x00\xff\xff"))
+	}
+	if w.frames.err != nil {
+		return w.frames.err
+	}
+	return w.frames.send(w.frames.buffer, true)
+}
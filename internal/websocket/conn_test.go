@@ -0,0 +1,249 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPair connects a server side and a client side Conn over loopback TCP, which unlike net.Pipe buffers writes, so one side can send a close
+// frame without the other reading at that very moment.
+func newPair(t *testing.T, compress bool) (*Conn, *Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	serverConn := <-accepted
+	require.NotNil(t, serverConn)
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+	server := newConn(serverConn, bufio.NewReader(serverConn), bufio.NewWriter(serverConn), true, compress)
+	client := newConn(clientConn, bufio.NewReader(clientConn), bufio.NewWriter(clientConn), false, compress)
+	return server, client
+}
+
+// expectClose reads from c until the peer's close frame comes in and returns its code.
+func expectClose(t *testing.T, c *Conn) int {
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := c.ReadMessage()
+	var closeErr *CloseError
+	require.True(t, errors.As(err, &closeErr), "expected a close frame, got %v", err)
+	return closeErr.Code
+}
+
+func TestMessagesBothWays(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		server, client := newPair(t, compress)
+		large := strings.Repeat("fragmented and maybe compressed ", 1000)
+
+		require.NoError(t, client.WriteMessage(TextMessage, []byte("hello")))
+		require.NoError(t, client.WriteMessage(BinaryMessage, []byte{0, 1, 2, 0xff}))
+		require.NoError(t, client.WriteMessage(TextMessage, []byte(large)))
+		require.NoError(t, client.WriteMessage(TextMessage, nil))
+
+		messageType, data, err := server.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, TextMessage, messageType)
+		assert.Equal(t, "hello", string(data))
+		messageType, data, err = server.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, BinaryMessage, messageType)
+		assert.Equal(t, []byte{0, 1, 2, 0xff}, data)
+		_, data, err = server.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, large, string(data))
+		_, data, err = server.ReadMessage()
+		require.NoError(t, err)
+		assert.Empty(t, data)
+
+		require.NoError(t, server.WriteMessage(TextMessage, []byte(large)))
+		_, data, err = client.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, large, string(data))
+	}
+}
+
+func TestStreamedMessageIsFragmented(t *testing.T) {
+	server, client := newPair(t, false)
+	w, err := server.NextWriter(BinaryMessage)
+	require.NoError(t, err)
+	w.Write(bytes.Repeat([]byte{'a'}, frameSize))
+	w.Write(bytes.Repeat([]byte{'b'}, frameSize + 10))
+	require.NoError(t, w.Close())
+
+	// read the raw frames: a binary frame, then continuations, the last one with FIN set
+	var opcodes []byte
+	total := 0
+	for {
+		f, err := client.readFrame(DefaultReadLimit)
+		require.NoError(t, err)
+		opcodes = append(opcodes, f.opcode)
+		total += len(f.payload)
+		if f.fin {
+			break
+		}
+	}
+	assert.Equal(t, []byte{opBinary, opContinuation, opContinuation}, opcodes)
+	assert.Equal(t, 2 * frameSize + 10, total)
+}
+
+func TestControlFramesBetweenFragments(t *testing.T) {
+	server, client := newPair(t, false)
+	pongs := make(chan string, 1)
+	client.SetPongHandler(func(data []byte) { pongs <- string(data) })
+
+	require.NoError(t, client.writeFrame(opText, false, false, []byte("hel")))
+	require.NoError(t, client.Ping([]byte("are you there")))
+	require.NoError(t, client.writeFrame(opContinuation, false, false, []byte("lo ")))
+	require.NoError(t, client.writeFrame(opContinuation, true, false, []byte("world")))
+
+	_, data, err := server.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+
+	// the pong only shows up on the client once it reads
+	require.NoError(t, server.WriteMessage(TextMessage, []byte("done")))
+	_, data, err = client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "done", string(data))
+	assert.Equal(t, "are you there", <-pongs)
+}
+
+func TestCloseHandshake(t *testing.T) {
+	server, client := newPair(t, false)
+	serverErr := make(chan error, 1)
+	go func() {
+		_, _, err := server.ReadMessage()
+		serverErr <- err
+	}()
+
+	require.NoError(t, client.Close())
+	var closeErr *CloseError
+	require.True(t, errors.As(<-serverErr, &closeErr))
+	assert.Equal(t, CloseNormalClosure, closeErr.Code)
+	assert.ErrorIs(t, server.WriteMessage(TextMessage, []byte("too late")), ErrCloseSent)
+
+	// a close without a code is reported as such, and answered with an empty close frame
+	server, client = newPair(t, false)
+	require.NoError(t, client.writeFrame(opClose, true, false, nil))
+	assert.Equal(t, CloseNoStatusReceived, expectClose(t, server))
+	assert.Equal(t, CloseNoStatusReceived, expectClose(t, client))
+}
+
+func TestProtocolViolations(t *testing.T) {
+	cases := []struct {
+		name string
+		send func(client *Conn) error
+		code int
+		err error
+	}{
+		{"unmasked frame", func(client *Conn) error {
+			client.isServer = true
+			defer func() { client.isServer = false }()
+			return client.writeFrame(opText, true, false, []byte("x"))
+		}, CloseProtocolError, ErrProtocol},
+		{"continuation without a message", func(client *Conn) error {
+			return client.writeFrame(opContinuation, true, false, []byte("x"))
+		}, CloseProtocolError, ErrProtocol},
+		{"new message inside a fragmented one", func(client *Conn) error {
+			client.writeFrame(opText, false, false, []byte("x"))
+			return client.writeFrame(opText, true, false, []byte("y"))
+		}, CloseProtocolError, ErrProtocol},
+		{"fragmented ping", func(client *Conn) error {
+			return client.writeFrame(opPing, false, false, nil)
+		}, CloseProtocolError, ErrProtocol},
+		{"oversized ping", func(client *Conn) error {
+			return client.writeFrame(opPing, true, false, make([]byte, 126))
+		}, CloseProtocolError, ErrProtocol},
+		{"unknown opcode", func(client *Conn) error {
+			return client.writeFrame(0x3, true, false, nil)
+		}, CloseProtocolError, ErrProtocol},
+		{"compressed without the extension", func(client *Conn) error {
+			return client.writeFrame(opText, true, true, []byte("x"))
+		}, CloseProtocolError, ErrProtocol},
+		{"invalid close code", func(client *Conn) error {
+			return client.WriteClose(1005, "")
+		}, CloseProtocolError, ErrProtocol},
+		{"invalid UTF-8", func(client *Conn) error {
+			return client.WriteMessage(TextMessage, []byte{0xff, 0xfe})
+		}, CloseInvalidFramePayloadData, ErrInvalidUTF8},
+		{"over the read limit", func(client *Conn) error {
+			return client.WriteMessage(BinaryMessage, make([]byte, 2048))
+		}, CloseMessageTooBig, ErrMessageTooBig},
+	}
+	for _, c := range cases {
+		server, client := newPair(t, false)
+		server.readLimit = 1024
+		require.NoError(t, c.send(client), c.name)
+		_, _, err := server.ReadMessage()
+		assert.ErrorIs(t, err, c.err, c.name)
+		assert.Equal(t, c.code, expectClose(t, client), c.name)
+		// the error is sticky
+		_, _, again := server.ReadMessage()
+		assert.Equal(t, err, again, c.name)
+	}
+}
+
+func TestClaimedLengthIsNotAllocated(t *testing.T) {
+	server, client := newPair(t, false)
+	// a masked binary frame claiming 16 MB, of which only a few bytes ever arrive
+	frame := []byte{finBit | byte(BinaryMessage), maskBit | 127, 0, 0, 0, 0, 0x01, 0, 0, 0, 1, 2, 3, 4}
+	frame = append(frame, "short"...)
+	_, err := client.conn.Write(frame)
+	require.NoError(t, err)
+	client.conn.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, _, err = server.ReadMessage()
+	runtime.ReadMemStats(&after)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Less(t, after.TotalAlloc - before.TotalAlloc, uint64(1 << 20))
+}
+
+func TestCompressedBombIsRefused(t *testing.T) {
+	server, client := newPair(t, true)
+	server.readLimit = 64 << 10
+	var compressed bytes.Buffer
+	w, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	w.Write(make([]byte, 10 << 20))
+	w.Flush()
+	payload := bytes.TrimSuffix(compressed.Bytes(), []byte("\x00\x00\xff\xff"))
+	require.Less(t, len(payload), 64 << 10, "the compressed message itself fits the limit")
+
+	require.NoError(t, client.writeFrame(opBinary, true, true, payload))
+	_, _, err := server.ReadMessage()
+	assert.ErrorIs(t, err, ErrMessageTooBig)
+	assert.Equal(t, CloseMessageTooBig, expectClose(t, client))
+}
+
+func TestCompressedMessageIsSmaller(t *testing.T) {
+	server, client := newPair(t, true)
+	text := strings.Repeat("squeeze ", 500)
+	require.NoError(t, server.WriteMessage(TextMessage, []byte(text)))
+	f, err := client.readFrame(DefaultReadLimit)
+	require.NoError(t, err)
+	assert.True(t, f.rsv1)
+	assert.True(t, f.fin)
+	assert.Less(t, len(f.payload), len(text) / 10)
+	inflated, err := client.inflate(f.payload)
+	require.NoError(t, err)
+	assert.Equal(t, text, string(inflated))
+}
@@ -0,0 +1,195 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"github.com/juancruzfl/httpserver/internal/headers"
+	"github.com/juancruzfl/httpserver/internal/request"
+	"github.com/juancruzfl/httpserver/internal/response"
+)
+
+// acceptGUID is the fixed GUID of RFC 6455 that the server appends to the key of the client to prove it understood the handshake.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrBadHandshake is returned by Upgrade when the request is not a valid WebSocket handshake. The client has already been answered.
+var ErrBadHandshake = errors.New("Bad WebSocket handshake")
+
+// Upgrader turns an HTTP request into a WebSocket connection. The zero value accepts same origin requests without subprotocols or
+// compression.
+type Upgrader struct {
+	// Subprotocols are the subprotocols the server speaks, in order of preference. The first one the client also offers is picked.
+	Subprotocols []string
+	// CheckOrigin decides whether a request from a browser page is allowed. Nil only allows requests without an Origin, or with one whose
+	// host is the Host of the request.
+	CheckOrigin func(r *request.Request) bool
+	// EnableCompression offers permessage-deflate to clients that ask for it.
+	EnableCompression bool
+	// ReadLimit caps the size of a message read from the client, after decompression. Zero means DefaultReadLimit.
+	ReadLimit int64
+}
+
+// Upgrade checks the handshake of the request, answers it with a 101 Switching Protocols and takes the connection over. Headers the handler set
+// on w, like cookies, go out with the 101. When the handshake is not valid the client gets an error response and an error wrapping
+// ErrBadHandshake is returned.
+//
+// sidenote: the checks follow section 4.2.1 of RFC 6455. A client speaking another version of the protocol gets a 426 telling it the one version
+// we speak, which is what lets it retry with that one.
+func (u *Upgrader) Upgrade(w response.ResponseWriter, r *request.Request) (*Conn, error) {
+	if r.RequestLine.Method != "GET" {
+		w.GetHeaders().Set("Allow", "GET")
+		return nil, u.fail(w, response.StatusMethodNotAllowed, "Method is not GET")
+	}
+	if !headerHasToken(r, "Connection", "upgrade") || !headerHasToken(r, "Upgrade", "websocket") {
+		w.GetHeaders().Set("Upgrade", "websocket")
+		return nil, u.fail(w, response.StatusUpgradeRequired, "Request does not ask for a websocket upgrade")
+	}
+	if version, _ := r.Headers.Get("Sec-WebSocket-Version"); version != "13" {
+		w.GetHeaders().Set("Sec-WebSocket-Version", "13")
+		return nil, u.fail(w, response.StatusUpgradeRequired, "Unsupported Sec-WebSocket-Version")
+	}
+	key, _ := r.Headers.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, u.fail(w, response.StatusBadRequest, "Invalid Sec-WebSocket-Key")
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		return nil, u.fail(w, response.StatusForbidden, "Origin not allowed")
+	}
+	hijacker, ok := w.(response.Hijacker)
+	if !ok {
+		return nil, u.fail(w, response.StatusInternalServerError, "Response writer does not support hijacking")
+	}
+
+	h := w.GetHeaders().Clone()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", acceptKey(key))
+	subprotocol := u.selectSubprotocol(r)
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	compress := u.EnableCompression && acceptsDeflate(r)
+	if compress {
+		// sidenote: without context takeover every message is compressed on its own. It costs some ratio, but neither side has to keep a 32 KB
+		// window around per connection between messages, and it is the one setting every client supports.
+		h.Set("Sec-WebSocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
+	}
+	h.Del("Content-Length")
+	h.Del("Transfer-Encoding")
+
+	netConn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, u.fail(w, response.StatusInternalServerError, err.Error())
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	if err := h.Write(rw); err != nil && !errors.Is(err, headers.ErrInvalidField) {
+		netConn.Close()
+		return nil, err
+	}
+	rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	readLimit := u.ReadLimit
+	if readLimit <= 0 {
+		readLimit = DefaultReadLimit
+	}
+	c := newConn(netConn, rw.Reader, rw.Writer, true, compress)
+	c.subprotocol = subprotocol
+	c.readLimit = readLimit
+	return c, nil
+}
+
+func (u *Upgrader) fail(w response.ResponseWriter, status int, reason string) error {
+	w.GetHeaders().Set("Content-Type", "text/plain; charset=utf-8")
+	w.CustomWriteHeader(status)
+	w.Write([]byte(reason))
+	return fmt.Errorf("%w: %s", ErrBadHandshake, reason)
+}
+
+func (u *Upgrader) selectSubprotocol(r *request.Request) string {
+	offered := headerTokens(r, "Sec-WebSocket-Protocol")
+	for _, supported := range u.Subprotocols {
+		for _, protocol := range offered {
+			if protocol == supported {
+				return supported
+			}
+		}
+	}
+	return ""
+}
+
+// acceptKey computes Sec-WebSocket-Accept from the key of the client.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// acceptsDeflate reports whether the client offers permessage-deflate with parameters we can honour. We always compress with the full 32 KB
+// window, so an offer limiting the window of the server is turned down.
+func acceptsDeflate(r *request.Request) bool {
+	for _, offer := range headerTokens(r, "Sec-WebSocket-Extensions") {
+		params := strings.Split(offer, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+		acceptable := true
+		for _, param := range params[1:] {
+			name, _, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch strings.TrimSpace(name) {
+			case "server_no_context_takeover", "client_no_context_takeover", "client_max_window_bits":
+			default:
+				acceptable = false
+			}
+		}
+		if acceptable {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin is the default CheckOrigin. Browsers always send Origin, so a request without one is not coming from a page on another site.
+func sameOrigin(r *request.Request) bool {
+	origin, ok := r.Headers.Get("Origin")
+	if !ok {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host, _ := r.Headers.Get("Host")
+	return strings.EqualFold(u.Host, host)
+}
+
+// headerTokens splits every field of the named header on commas and returns the trimmed, non empty parts.
+func headerTokens(r *request.Request, name string) []string {
+	var tokens []string
+	for _, value := range r.Headers.Values(name) {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+func headerHasToken(r *request.Request, name string, token string) bool {
+	for _, t := range headerTokens(r, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
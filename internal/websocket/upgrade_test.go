@@ -0,0 +1,188 @@
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"github.com/juancruzfl/httpserver/internal/handler"
+	"github.com/juancruzfl/httpserver/internal/headers"
+	"github.com/juancruzfl/httpserver/internal/request"
+	"github.com/juancruzfl/httpserver/internal/response"
+	"github.com/juancruzfl/httpserver/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+func TestAcceptKey(t *testing.T) {
+	// the example from section 1.3 of RFC 6455
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", acceptKey(testKey))
+}
+
+// recorder is a ResponseWriter that can't be hijacked.
+type recorder struct {
+	status int
+	headers *headers.Headers
+	body strings.Builder
+}
+
+func (r *recorder) GetHeaders() *headers.Headers { return r.headers }
+func (r *recorder) CustomWriteHeader(status int) { r.status = status }
+func (r *recorder) Write(data []byte) (int, error) { return r.body.WriteString(string(data)) }
+
+func handshakeRequest(method string, fields map[string]string) *request.Request {
+	hs := headers.NewHeaders()
+	hs.Set("Host", "example.com")
+	hs.Set("Connection", "keep-alive, Upgrade")
+	hs.Set("Upgrade", "websocket")
+	hs.Set("Sec-WebSocket-Version", "13")
+	hs.Set("Sec-WebSocket-Key", testKey)
+	for name, value := range fields {
+		if value == "" {
+			hs.Del(name)
+		} else {
+			hs.Set(name, value)
+		}
+	}
+	return request.NewMockRequest(request.NewMockRequestLine("1.1", "/ws", method), *hs, nil, 0)
+}
+
+func TestUpgradeRejectsBadHandshakes(t *testing.T) {
+	cases := []struct {
+		name string
+		method string
+		fields map[string]string
+		status int
+	}{
+		{"not GET", "POST", nil, response.StatusMethodNotAllowed},
+		{"no Upgrade", "GET", map[string]string{"Upgrade": ""}, response.StatusUpgradeRequired},
+		{"no Connection upgrade", "GET", map[string]string{"Connection": "keep-alive"}, response.StatusUpgradeRequired},
+		{"old version", "GET", map[string]string{"Sec-WebSocket-Version": "8"}, response.StatusUpgradeRequired},
+		{"missing key", "GET", map[string]string{"Sec-WebSocket-Key": ""}, response.StatusBadRequest},
+		{"short key", "GET", map[string]string{"Sec-WebSocket-Key": "c2hvcnQ="}, response.StatusBadRequest},
+		{"cross origin", "GET", map[string]string{"Origin": "https://evil.example"}, response.StatusForbidden},
+		{"same origin, no hijacking", "GET", map[string]string{"Origin": "https://example.com"}, response.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		w := &recorder{headers: headers.NewHeaders()}
+		conn, err := (&Upgrader{}).Upgrade(w, handshakeRequest(c.method, c.fields))
+		assert.Nil(t, conn, c.name)
+		assert.ErrorIs(t, err, ErrBadHandshake, c.name)
+		assert.Equal(t, c.status, w.status, c.name)
+	}
+
+	w := &recorder{headers: headers.NewHeaders()}
+	(&Upgrader{}).Upgrade(w, handshakeRequest("GET", map[string]string{"Sec-WebSocket-Version": "8"}))
+	version, _ := w.headers.Get("Sec-WebSocket-Version")
+	assert.Equal(t, "13", version, "a client on another version is told which one we speak")
+}
+
+func TestSubprotocolAndExtensionNegotiation(t *testing.T) {
+	u := &Upgrader{Subprotocols: []string{"v2.chat", "v1.chat"}}
+	r := handshakeRequest("GET", map[string]string{"Sec-WebSocket-Protocol": "v1.chat, v2.chat"})
+	assert.Equal(t, "v2.chat", u.selectSubprotocol(r), "the server's preference wins")
+	r = handshakeRequest("GET", map[string]string{"Sec-WebSocket-Protocol": "mqtt"})
+	assert.Equal(t, "", u.selectSubprotocol(r))
+
+	assert.True(t, acceptsDeflate(handshakeRequest("GET", map[string]string{
+		"Sec-WebSocket-Extensions": "permessage-deflate; client_max_window_bits"})))
+	assert.False(t, acceptsDeflate(handshakeRequest("GET", map[string]string{
+		"Sec-WebSocket-Extensions": "permessage-deflate; server_max_window_bits=10"})))
+	assert.True(t, acceptsDeflate(handshakeRequest("GET", map[string]string{
+		"Sec-WebSocket-Extensions": "permessage-deflate; server_max_window_bits=10, permessage-deflate"})))
+	assert.False(t, acceptsDeflate(handshakeRequest("GET", map[string]string{"Sec-WebSocket-Extensions": "x-webkit-deflate-frame"})))
+}
+
+// startEchoServer serves an upgrader that echoes every message back until the client closes.
+func startEchoServer(t *testing.T, u *Upgrader, middleware ...handler.Middleware) (string, chan error) {
+	done := make(chan error, 1)
+	mux := server.NewServerMux()
+	mux.HandleFunc("GET", "/ws", func(w response.ResponseWriter, r *request.Request) {
+		w.GetHeaders().Set("Set-Cookie", "session=abc")
+		conn, err := u.Upgrade(w, r)
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				done <- err
+				return
+			}
+		}
+	}, middleware...)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &server.Server{Handler: mux, WriteTimeout: 50 * time.Millisecond}
+	go s.Serve(listener)
+	t.Cleanup(func() { s.Close() })
+	return listener.Addr().String(), done
+}
+
+func dial(t *testing.T, addr string, extra string) (*Conn, string) {
+	netConn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { netConn.Close() })
+	netConn.Write([]byte("GET /ws HTTP/1.1\r\nHost: " + addr + "\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + testKey + "\r\n" + extra + "\r\n"))
+	reader := bufio.NewReader(netConn)
+	var head strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	// field names are case insensitive, and ours go out in their canonical form, Sec-Websocket-Accept and the like
+	compress := strings.Contains(strings.ToLower(head.String()), "sec-websocket-extensions: permessage-deflate")
+	return newConn(netConn, reader, bufio.NewWriter(netConn), false, compress), head.String()
+}
+
+func TestUpgradeAndEcho(t *testing.T) {
+	u := &Upgrader{Subprotocols: []string{"chat"}, EnableCompression: true}
+	addr, done := startEchoServer(t, u, handler.Compress(1))
+	client, head := dial(t, addr, "Sec-WebSocket-Protocol: chat\r\nSec-WebSocket-Extensions: permessage-deflate\r\n")
+
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 101 Switching Protocols\r\n"), head)
+	assert.Contains(t, head, "Sec-Websocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+	assert.Contains(t, head, "Sec-Websocket-Protocol: chat\r\n")
+	assert.Contains(t, head, "Set-Cookie: session=abc\r\n")
+	assert.NotContains(t, head, "Content-Length")
+	assert.NotContains(t, head, "Content-Encoding")
+	require.True(t, client.compress)
+
+	// the write timeout of the server is long gone by the time the second message goes out, which a hijacked connection doesn't care about
+	large := strings.Repeat("echo ", 5000)
+	for _, message := range []string{"hello", large} {
+		require.NoError(t, client.WriteMessage(TextMessage, []byte(message)))
+		messageType, data, err := client.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, TextMessage, messageType)
+		assert.Equal(t, message, string(data))
+		time.Sleep(60 * time.Millisecond)
+	}
+
+	require.NoError(t, client.Close())
+	var closeErr *CloseError
+	require.True(t, errors.As(<-done, &closeErr))
+	assert.Equal(t, CloseNormalClosure, closeErr.Code)
+}
+
+func TestUpgradeFailureIsAnHTTPResponse(t *testing.T) {
+	addr, done := startEchoServer(t, &Upgrader{})
+	_, head := dial(t, addr, "Origin: https://evil.example\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 403 Forbidden"), head)
+	assert.ErrorIs(t, <-done, ErrBadHandshake)
+}